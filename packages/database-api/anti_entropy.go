@@ -0,0 +1,188 @@
+package main
+
+import (
+  "crypto/sha1"
+  "math/rand"
+  "time"
+)
+
+// MerkleExchangeArgs carries the initiator's hash for the tree node
+// identified by Path (a sequence of child indices from the root), so
+// the responder can tell it whether that subtree has diverged.
+type MerkleExchangeArgs struct {
+  Path []int
+  Hash [sha1.Size]byte
+}
+
+type MerkleExchangeReply struct {
+  Match bool // true if the responder's node at Path has the same hash
+  Leaf bool // true if the responder's node at Path is a leaf
+  RangeStart, RangeEnd uint32 // set when Leaf
+  ChildHashes [][sha1.Size]byte // set when not Match and not Leaf
+  Err Err
+}
+
+// MerkleExchange compares the caller's view of a Merkle tree node
+// against this replica's own, reporting either a match, the leaf's
+// token range (so the caller can pull the messages it covers), or the
+// node's children hashes (so the caller can recurse into whichever
+// ones differ).
+func (db *MMDatabase) MerkleExchange(args *MerkleExchangeArgs, reply *MerkleExchangeReply) error {
+  tree := db.getMerkleTree()
+  node := tree.nodeAt(args.Path)
+  if node == nil {
+    reply.Match = true
+    reply.Err = OK
+    return nil
+  }
+
+  if node.hash == args.Hash {
+    reply.Match = true
+    reply.Err = OK
+    return nil
+  }
+
+  if len(node.children) == 0 {
+    reply.Leaf = true
+    reply.RangeStart = node.rangeStart
+    reply.RangeEnd = node.rangeEnd
+    reply.Err = OK
+    return nil
+  }
+
+  reply.ChildHashes = make([][sha1.Size]byte, len(node.children))
+  for i, child := range node.children {
+    reply.ChildHashes[i] = child.hash
+  }
+  reply.Err = OK
+  return nil
+}
+
+// exchangeMerkle walks this node's own Merkle tree top-down, asking
+// peer to confirm each subtree and descending only where peer reports
+// a mismatch, until it has enumerated every differing leaf and pulled
+// peer's messages for the ranges they cover.
+func (db *MMDatabase) exchangeMerkle(peer string) {
+  db.exchangeMerkleAt(peer, nil)
+}
+
+func (db *MMDatabase) exchangeMerkleAt(peer string, path []int) {
+  tree := db.getMerkleTree()
+  node := tree.nodeAt(path)
+  if node == nil {
+    return
+  }
+
+  args := &MerkleExchangeArgs{Path: path, Hash: node.hash}
+  reply := new(MerkleExchangeReply)
+  if !call(peer, "MMDatabase.MerkleExchange", args, reply) || reply.Err != OK || reply.Match {
+    return
+  }
+
+  if reply.Leaf || len(node.children) == 0 {
+    db.pullRange(peer, node.rangeStart, node.rangeEnd)
+    return
+  }
+
+  for i, child := range node.children {
+    if i >= len(reply.ChildHashes) || reply.ChildHashes[i] != child.hash {
+      childPath := append(append([]int{}, path...), i)
+      db.exchangeMerkleAt(peer, childPath)
+    }
+  }
+}
+
+// pullRange fetches every username whose messages fall in [start,end]
+// from peer and applies them locally via LocalPut, resolving this
+// replica's side of a Merkle tree mismatch. It asks peer which
+// usernames it holds in the range, rather than only considering
+// usernames this replica already has locally, so a replica that has
+// never seen a username at all can still discover and pull it.
+func (db *MMDatabase) pullRange(peer string, start, end uint32) {
+  usernames := db.peerUsernamesInRange(peer, start, end)
+  for username := range usernames {
+    args := &ReplicaGetArgs{Username: username}
+    reply := new(ReplicaGetReply)
+    if !call(peer, "MMDatabase.ReplicaGet", args, reply) || reply.Err != OK {
+      continue
+    }
+    for _, msg := range reply.Messages {
+      db.LocalPut(username, msg, RequestID{})
+    }
+  }
+}
+
+// peerUsernamesInRange returns the union of every username in
+// [start,end] that either this replica or peer currently holds.
+func (db *MMDatabase) peerUsernamesInRange(peer string, start, end uint32) map[string]bool {
+  out := make(map[string]bool)
+  for _, username := range db.usernamesInRange(start, end) {
+    out[username] = true
+  }
+
+  args := &UsernamesInRangeArgs{RangeStart: start, RangeEnd: end}
+  reply := new(UsernamesInRangeReply)
+  if call(peer, "MMDatabase.UsernamesInRange", args, reply) && reply.Err == OK {
+    for _, username := range reply.Usernames {
+      out[username] = true
+    }
+  }
+
+  return out
+}
+
+// usernamesInRange returns every username currently held locally whose
+// hash falls in [start,end].
+func (db *MMDatabase) usernamesInRange(start, end uint32) []string {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+
+  out := make([]string, 0)
+  for username := range db.store {
+    if inRange(hash(username), start, end) {
+      out = append(out, username)
+    }
+  }
+  return out
+}
+
+// UsernamesInRangeArgs/Reply let a peer performing a Merkle exchange
+// learn which usernames this replica holds in a token range, so it can
+// discover a username it has never seen locally (ReplicaGet alone only
+// serves usernames the caller already knows to ask for).
+type UsernamesInRangeArgs struct {
+  RangeStart, RangeEnd uint32
+}
+
+type UsernamesInRangeReply struct {
+  Usernames []string
+  Err Err
+}
+
+func (db *MMDatabase) UsernamesInRange(args *UsernamesInRangeArgs, reply *UsernamesInRangeReply) error {
+  reply.Usernames = db.usernamesInRange(args.RangeStart, args.RangeEnd)
+  reply.Err = OK
+  return nil
+}
+
+// runAntiEntropyLoop periodically exchanges Merkle trees with every
+// other known replica, on a randomized per-peer interval so exchanges
+// don't all land at once.
+func (db *MMDatabase) runAntiEntropyLoop() {
+  for !db.dead {
+    for _, peer := range db.servers {
+      if peer == db.servers[db.me] {
+        continue
+      }
+      // Each peer gets its own random offset into the round, so the
+      // exchanges with different peers are spread out.
+      go func(peer string) {
+        time.Sleep(time.Duration(rand.Int63n(int64(db.merkleRebuildInterval/2) + 1)))
+        db.exchangeMerkle(peer)
+      }(peer)
+    }
+
+    jitter := time.Duration(rand.Int63n(int64(db.merkleRebuildInterval) + 1))
+    time.Sleep(db.merkleRebuildInterval/2 + jitter)
+  }
+}
@@ -0,0 +1,69 @@
+package main
+
+import "time"
+
+const clerkMinRetryBackoff = 50 * time.Millisecond
+const clerkMaxRetryBackoff = 2 * time.Second
+
+// Clerk is the client-side handle used to make at-most-once Puts against
+// an MMDatabase cluster. Each Clerk remembers its own ClientID and the
+// Seq of its last request, so a Put that has to be retried against a
+// different coordinator still dedups correctly against LocalPut's
+// clientTable.
+type Clerk struct {
+  servers []string // Fallback list, used until a preference list is known
+  clientID int64
+  seq int64
+}
+
+// MakeClerk returns a Clerk that will start out talking to servers,
+// generating a fresh ClientID that no other Clerk will collide with.
+func MakeClerk(servers []string) *Clerk {
+  ck := new(Clerk)
+  ck.servers = servers
+  ck.clientID = nrand()
+  return ck
+}
+
+// Put stores msg under username, retrying against successive entries of
+// username's preference list until one of them, as the current Raft
+// leader for that group, applies it.
+func (ck *Clerk) Put(username string, msg Message) Err {
+  ck.seq++
+  id := RequestID{ClientID: ck.clientID, Seq: ck.seq}
+
+  prefList := ck.preferenceList(username)
+  backoff := clerkMinRetryBackoff
+  for {
+    for _, server := range prefList {
+      args := &CoordinatorPutArgs{Username: username, ID: id, Msg: msg}
+      reply := new(CoordinatorPutReply)
+      if call(server, "MMDatabase.CoordinatorPutRPC", args, reply) && reply.Err == OK {
+        return OK
+      }
+    }
+    // Every server we tried was wrong, unreachable, or timed out; back
+    // off so a preference list that's entirely down doesn't spin this
+    // loop making unthrottled RPCs, then refresh it before retrying
+    // since it may have changed (e.g. resharding).
+    time.Sleep(backoff)
+    backoff *= 2
+    if backoff > clerkMaxRetryBackoff {
+      backoff = clerkMaxRetryBackoff
+    }
+    prefList = ck.preferenceList(username)
+  }
+}
+
+// preferenceList asks any known server for username's current
+// preference list, falling back to ck.servers if none answer.
+func (ck *Clerk) preferenceList(username string) []string {
+  for _, server := range ck.servers {
+    args := &GetCoordinatorListArgs{Username: username}
+    reply := new(GetCoordinatorListReply)
+    if call(server, "MMDatabase.GetCoordinatorListRPC", args, reply) && len(reply.Servers) > 0 {
+      return reply.Servers
+    }
+  }
+  return ck.servers
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+  "bufio"
+  "encoding/gob"
+  "log"
+  "os"
+  "sync"
+)
+
+// clientTableStore persists db.clientTable to disk, alongside the
+// message store, so a coordinator that crashes and restarts still
+// remembers every client's last-seen Seq and doesn't risk re-applying
+// a retried Put as a duplicate.
+type clientTableStore struct {
+  mu sync.Mutex
+  path string
+}
+
+func newClientTableStore(path string) *clientTableStore {
+  return &clientTableStore{path: path}
+}
+
+// Load returns the table most recently saved at path, or an empty
+// table if nothing has been saved yet.
+func (s *clientTableStore) Load() map[int64]clientRecord {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  table := make(map[int64]clientRecord)
+  f, err := os.Open(s.path)
+  if err != nil {
+    return table
+  }
+  defer f.Close()
+
+  if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&table); err != nil {
+    log.Printf("clientTableStore: decode %s: %v", s.path, err)
+    return make(map[int64]clientRecord)
+  }
+  return table
+}
+
+// Save durably overwrites the table at path with table, via a
+// write-then-rename so a crash mid-write never leaves a truncated file
+// behind for the next Load.
+func (s *clientTableStore) Save(table map[int64]clientRecord) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  tmp := s.path + ".tmp"
+  f, err := os.Create(tmp)
+  if err != nil {
+    log.Printf("clientTableStore: create %s: %v", tmp, err)
+    return
+  }
+
+  if err := gob.NewEncoder(f).Encode(table); err != nil {
+    log.Printf("clientTableStore: encode: %v", err)
+    f.Close()
+    return
+  }
+  if err := f.Close(); err != nil {
+    log.Printf("clientTableStore: close %s: %v", tmp, err)
+    return
+  }
+  if err := os.Rename(tmp, s.path); err != nil {
+    log.Printf("clientTableStore: rename %s to %s: %v", tmp, s.path, err)
+  }
+}
@@ -1,17 +1,14 @@
-package mmdatabase
+package main
 
 import "hash/fnv"
 
-const (
-  OK = "OK"
-  ErrWrongCoordinator = "ErrWrongCoordinator"
-)
 type Err string
 
 type ReplicaPutArgs struct {
   Username string
   Msg Message
   Handoff bool
+  ID RequestID
 }
 
 type ReplicaPutReply struct {
@@ -27,7 +24,22 @@ type MessageID struct {
   // TODO
 }
 
-type sameID(id1 RequestID, id2 RequestID) bool {
+// VectorClock tracks, per server index, how many times a message has been
+// written via LocalPut on that server. It is attached to every Message so
+// that replicas can detect which of several conflicting copies is newest.
+type VectorClock map[int]int64
+
+type ReplicaGetArgs struct {
+  Username string
+}
+
+type ReplicaGetReply struct {
+  Messages []Message
+  Err Err
+}
+
+// sameID reports whether id1 and id2 identify the same client request.
+func sameID(id1 RequestID, id2 RequestID) bool {
   return id1.ClientID == id2.ClientID && id1.Seq == id2.Seq
 }
 
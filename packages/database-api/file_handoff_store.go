@@ -0,0 +1,132 @@
+package main
+
+import (
+  "bytes"
+  "encoding/gob"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "sync"
+)
+
+// fileHandoffStore is the durable HandoffStore: every pending handoff
+// is gob-encoded to its own file, named after its monotonic sequence
+// number, inside dir. A coordinator crash between accepting a write
+// and delivering its handoffs doesn't lose the hint, since the file
+// survives it; Ack removes the file once delivery succeeds. This
+// avoids pulling in a third-party store (e.g. BoltDB) that the
+// repository has no module manifest or vendor directory to resolve.
+type fileHandoffStore struct {
+  mu sync.Mutex
+  dir string
+  nextSeq HandoffSeq
+}
+
+// newFileHandoffStore opens (creating if necessary) dir for use as a
+// HandoffStore, recovering nextSeq from whatever entries are already
+// on disk.
+func newFileHandoffStore(dir string) (*fileHandoffStore, error) {
+  if err := os.MkdirAll(dir, 0700); err != nil {
+    return nil, err
+  }
+
+  s := &fileHandoffStore{dir: dir}
+  entries, err := s.load()
+  if err != nil {
+    return nil, err
+  }
+  for _, entry := range entries {
+    if entry.seq >= s.nextSeq {
+      s.nextSeq = entry.seq + 1
+    }
+  }
+  return s, nil
+}
+
+func (s *fileHandoffStore) path(seq HandoffSeq) string {
+  return filepath.Join(s.dir, strconv.FormatUint(uint64(seq), 10))
+}
+
+func (s *fileHandoffStore) Enqueue(msg *Message) error {
+  s.mu.Lock()
+  seq := s.nextSeq
+  s.nextSeq++
+  s.mu.Unlock()
+
+  f, err := os.Create(s.path(seq))
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+
+  return gob.NewEncoder(f).Encode(msg)
+}
+
+func (s *fileHandoffStore) Ack(seq HandoffSeq) error {
+  err := os.Remove(s.path(seq))
+  if os.IsNotExist(err) {
+    return nil
+  }
+  return err
+}
+
+func (s *fileHandoffStore) Iter() HandoffIterator {
+  entries, _ := s.load()
+  return &fileHandoffIterator{entries: entries}
+}
+
+type fileHandoffEntry struct {
+  seq HandoffSeq
+  msg *Message
+}
+
+// load reads every pending entry currently on disk, sorted by sequence
+// number, skipping rather than failing on any file that doesn't decode
+// cleanly (e.g. one truncated by a crash mid-write).
+func (s *fileHandoffStore) load() ([]fileHandoffEntry, error) {
+  files, err := ioutil.ReadDir(s.dir)
+  if err != nil {
+    return nil, err
+  }
+
+  entries := make([]fileHandoffEntry, 0, len(files))
+  for _, info := range files {
+    seq, err := strconv.ParseUint(info.Name(), 10, 64)
+    if err != nil {
+      continue
+    }
+
+    data, err := ioutil.ReadFile(filepath.Join(s.dir, info.Name()))
+    if err != nil {
+      continue
+    }
+
+    var msg Message
+    if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&msg); err != nil {
+      continue
+    }
+
+    entries = append(entries, fileHandoffEntry{seq: HandoffSeq(seq), msg: &msg})
+  }
+
+  sort.Slice(entries, func(i, j int) bool {
+    return entries[i].seq < entries[j].seq
+  })
+  return entries, nil
+}
+
+type fileHandoffIterator struct {
+  entries []fileHandoffEntry
+  pos int
+}
+
+func (it *fileHandoffIterator) Next() (HandoffSeq, *Message, bool) {
+  if it.pos >= len(it.entries) {
+    return 0, nil, false
+  }
+  entry := it.entries[it.pos]
+  it.pos++
+  return entry.seq, entry.msg, true
+}
@@ -0,0 +1,35 @@
+package main
+
+// HandoffSeq identifies a single hinted-handoff entry. Sequence numbers
+// increase monotonically in enqueue order and no two pending entries
+// share one. A number whose entry was acked can be handed out again
+// after a restart: fileHandoffStore resumes numbering after the highest
+// entry still on disk.
+type HandoffSeq uint64
+
+// HandoffStore is the durability boundary for hinted handoff: every
+// message that needs to be handed off to another replica is enqueued
+// here before runHandoffLoop attempts delivery, so a coordinator crash
+// between accepting a write and delivering its handoffs doesn't lose
+// the hint.
+type HandoffStore interface {
+  // Enqueue durably records msg as needing handoff and returns once it
+  // would survive a crash.
+  Enqueue(msg *Message) error
+
+  // Iter returns an iterator over every handoff entry not yet acked,
+  // in the order it was enqueued.
+  Iter() HandoffIterator
+
+  // Ack removes the entry at seq, e.g. once its handoff has been
+  // delivered successfully.
+  Ack(seq HandoffSeq) error
+}
+
+// HandoffIterator walks the entries of a HandoffStore that are still
+// pending delivery.
+type HandoffIterator interface {
+  // Next advances the iterator and reports whether an entry was
+  // available.
+  Next() (HandoffSeq, *Message, bool)
+}
@@ -0,0 +1,67 @@
+package main
+
+import "sync"
+
+// memoryHandoffStore is the original in-memory hinted-handoff queue,
+// kept as the default HandoffStore for tests: it's fast and requires no
+// on-disk setup, at the cost of losing pending handoffs on crash.
+type memoryHandoffStore struct {
+  mu sync.Mutex
+  nextSeq HandoffSeq
+  pending map[HandoffSeq]*Message
+  order []HandoffSeq
+}
+
+func newMemoryHandoffStore() *memoryHandoffStore {
+  return &memoryHandoffStore{
+    pending: make(map[HandoffSeq]*Message),
+  }
+}
+
+func (s *memoryHandoffStore) Enqueue(msg *Message) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  seq := s.nextSeq
+  s.nextSeq++
+  s.pending[seq] = msg
+  s.order = append(s.order, seq)
+  return nil
+}
+
+func (s *memoryHandoffStore) Ack(seq HandoffSeq) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  delete(s.pending, seq)
+  return nil
+}
+
+func (s *memoryHandoffStore) Iter() HandoffIterator {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  order := make([]HandoffSeq, len(s.order))
+  copy(order, s.order)
+  return &memoryHandoffIterator{store: s, order: order}
+}
+
+type memoryHandoffIterator struct {
+  store *memoryHandoffStore
+  order []HandoffSeq
+  pos int
+}
+
+func (it *memoryHandoffIterator) Next() (HandoffSeq, *Message, bool) {
+  it.store.mu.Lock()
+  defer it.store.mu.Unlock()
+
+  for it.pos < len(it.order) {
+    seq := it.order[it.pos]
+    it.pos++
+    if msg, ok := it.store.pending[seq]; ok {
+      return seq, msg, true
+    }
+  }
+  return 0, nil, false
+}
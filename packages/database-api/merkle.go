@@ -0,0 +1,125 @@
+package main
+
+import (
+  "crypto/sha1"
+  "fmt"
+  "io"
+  "sort"
+)
+
+// merkleNode is one node of a MerkleTree. Leaves (len(children) == 0)
+// cover a contiguous range of the hash token space; internal nodes hash
+// the concatenation of their children's hashes.
+type merkleNode struct {
+  hash [sha1.Size]byte
+  children []*merkleNode
+  rangeStart, rangeEnd uint32 // only meaningful on leaves
+}
+
+// MerkleTree summarizes a node's local message store so two replicas
+// can find out where they differ without exchanging every message.
+type MerkleTree struct {
+  root *merkleNode
+}
+
+// nodeAt walks path (a sequence of child indices from the root) and
+// returns the node it identifies, or nil if path doesn't exist in this
+// tree.
+func (t *MerkleTree) nodeAt(path []int) *merkleNode {
+  if t == nil || t.root == nil {
+    return nil
+  }
+
+  node := t.root
+  for _, idx := range path {
+    if idx < 0 || idx >= len(node.children) {
+      return nil
+    }
+    node = node.children[idx]
+  }
+  return node
+}
+
+// inRange reports whether token falls in [start,end], treating the
+// range as wrapping around the uint32 space if end < start.
+func inRange(token, start, end uint32) bool {
+  if start <= end {
+    return token >= start && token <= end
+  }
+  return token >= start || token <= end
+}
+
+// buildMerkleTreeLocked rebuilds the Merkle tree over db.store. Callers
+// must hold db.mu. The token space is split into db.merkleFanout
+// equal-width leaf ranges, each leaf hashing every (username, message
+// id, vector clock) triple whose username falls in its range.
+func (db *MMDatabase) buildMerkleTreeLocked() *MerkleTree {
+  fanout := db.merkleFanout
+  if fanout <= 0 {
+    fanout = 1
+  }
+
+  span := (uint64(1) << 32) / uint64(fanout)
+  leaves := make([]*merkleNode, fanout)
+  for i := 0; i < fanout; i++ {
+    start := uint32(uint64(i) * span)
+    end := uint32(uint64(i+1)*span - 1)
+    if i == fanout-1 {
+      end = ^uint32(0)
+    }
+    leaves[i] = &merkleNode{
+      rangeStart: start,
+      rangeEnd: end,
+      hash: db.leafHashLocked(start, end),
+    }
+  }
+
+  root := &merkleNode{children: leaves}
+  h := sha1.New()
+  for _, leaf := range leaves {
+    h.Write(leaf.hash[:])
+  }
+  copy(root.hash[:], h.Sum(nil))
+
+  return &MerkleTree{root: root}
+}
+
+// leafHashLocked hashes every (username, message id, vector clock)
+// triple whose username hashes into [start,end]. Callers must hold
+// db.mu.
+func (db *MMDatabase) leafHashLocked(start, end uint32) [sha1.Size]byte {
+  var keys []string
+  for username, msgs := range db.store {
+    if !inRange(hash(username), start, end) {
+      continue
+    }
+    for _, msg := range msgs {
+      keys = append(keys, fmt.Sprintf("%s|%v|%v", username, msg.ID, msg.Clock))
+    }
+  }
+  sort.Strings(keys)
+
+  h := sha1.New()
+  for _, key := range keys {
+    io.WriteString(h, key)
+  }
+
+  var out [sha1.Size]byte
+  copy(out[:], h.Sum(nil))
+  return out
+}
+
+// getMerkleTree returns the current Merkle tree, rebuilding it first if
+// the store has changed since it was last built.
+func (db *MMDatabase) getMerkleTree() *MerkleTree {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+
+  if db.merkleTree != nil && db.merkleVersion == db.storeVersion {
+    return db.merkleTree
+  }
+
+  db.merkleTree = db.buildMerkleTreeLocked()
+  db.merkleVersion = db.storeVersion
+  return db.merkleTree
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+  "encoding/gob"
+  "strings"
+  "sync"
+
+  "github.com/jmoldow/MylarMail/packages/raft"
+)
+
+// putCommand is the only command type submitted to a raftGroup today;
+// LocalPut is invoked exclusively from runApplyLoop once the group has
+// agreed on it, so every replica in the group applies the same
+// sequence of puts.
+type putCommand struct {
+  Username string
+  Msg Message
+  ID RequestID
+}
+
+// putCommand travels behind raft's interface-typed Command field, both
+// in AppendEntries RPCs and in the persisted log, so gob must know it.
+func init() {
+  gob.Register(putCommand{})
+}
+
+// raftGroup is the Raft instance backing one preference list: every
+// server that appears in a given username's GetCoordinatorList shares a
+// group, and CoordinatorPut for that username is only accepted by the
+// group's current Raft leader.
+type raftGroup struct {
+  mu sync.Mutex
+  rf *raft.Raft
+  members []string
+  applyCh chan raft.ApplyMsg
+  waiters map[int]pendingPut
+  applied map[int]RequestID // committed indices whose waiter hasn't registered yet
+}
+
+// pendingPut is what CoordinatorPut leaves behind for runApplyLoop to
+// find at a log index: the request it's actually waiting on (by ID, so
+// a retry and its original submission are recognized as the same
+// request) and the channel to signal.
+type pendingPut struct {
+  id RequestID
+  ch chan Err
+}
+
+// groupIDFor returns the canonical identifier for the Raft group that
+// replicates username, derived from its preference list so every
+// member computes the same id.
+func groupIDFor(members []string) string {
+  return strings.Join(members, ",")
+}
+
+// groupFor returns the (possibly newly created) raftGroup for
+// username, or nil if this node isn't one of its replicas.
+func (db *MMDatabase) groupFor(username string) *raftGroup {
+  members := db.GetCoordinatorList(username)
+  groupID := groupIDFor(members)
+
+  db.mu.Lock()
+  group, ok := db.groups[groupID]
+  db.mu.Unlock()
+  if ok {
+    return group
+  }
+
+  return db.createGroup(groupID, members)
+}
+
+// createGroup lazily starts this node's Raft peer for groupID the
+// first time a username maps to it. Every member does this
+// independently on first contact; the group only needs a quorum of its
+// members to have done so for writes to succeed.
+func (db *MMDatabase) createGroup(groupID string, members []string) *raftGroup {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+
+  if group, ok := db.groups[groupID]; ok {
+    return group
+  }
+
+  me := -1
+  for i, server := range members {
+    if server == db.servers[db.me] {
+      me = i
+    }
+  }
+  if me == -1 {
+    return nil
+  }
+
+  group := &raftGroup{
+    members: members,
+    applyCh: make(chan raft.ApplyMsg, 16),
+    waiters: make(map[int]pendingPut),
+    applied: make(map[int]RequestID),
+  }
+  group.rf = raft.Make(members, me, newFilePersister(groupID), raftRPCClient{}, group.applyCh, raftServiceName(groupID))
+  db.rpcs.RegisterName(raftServiceName(groupID), group.rf)
+  db.groups[groupID] = group
+
+  go db.runApplyLoop(group)
+
+  return group
+}
+
+func raftServiceName(groupID string) string {
+  return "Raft-" + groupID
+}
+
+// runApplyLoop applies committed putCommands to the local store and
+// wakes up whichever CoordinatorPut is waiting on that log index. A
+// leadership change can overwrite a tentatively-appended entry before
+// it commits, so the command actually applied at an index is checked
+// against the one the waiter submitted (by RequestID) before reporting
+// success; a mismatch means this node's submission was never applied
+// and the caller is told to retry instead. CoordinatorPut registers its
+// waiter after rf.Start returns, so it's possible (e.g. under a fast
+// heartbeat-driven commit) for this loop to apply an index before
+// anyone is waiting on it; in that case the result is stashed in
+// group.applied for waitFor to pick up instead of being dropped.
+func (db *MMDatabase) runApplyLoop(group *raftGroup) {
+  for msg := range group.applyCh {
+    if !msg.CommandValid {
+      continue
+    }
+
+    cmd := msg.Command.(putCommand)
+    db.LocalPut(cmd.Username, cmd.Msg, cmd.ID)
+
+    group.mu.Lock()
+    if waiter, ok := group.waiters[msg.CommandIndex]; ok {
+      delete(group.waiters, msg.CommandIndex)
+      if sameID(waiter.id, cmd.ID) {
+        waiter.ch <- OK
+      } else {
+        waiter.ch <- ErrWrongCoordinator
+      }
+    } else {
+      group.applied[msg.CommandIndex] = cmd.ID
+    }
+    group.mu.Unlock()
+  }
+}
+
+// waitFor blocks until index is applied by the group, returning OK if
+// the command applied there was id's or ErrWrongCoordinator if a
+// different command won that index instead (e.g. after a leadership
+// change). It is safe to call immediately after rf.Start returns index,
+// even if runApplyLoop has already raced ahead and applied it: that
+// race is resolved by checking group.applied, rather than registering
+// a channel runApplyLoop has no reason to ever signal.
+func (group *raftGroup) waitFor(index int, id RequestID) Err {
+  group.mu.Lock()
+
+  if appliedID, ok := group.applied[index]; ok {
+    delete(group.applied, index)
+    group.mu.Unlock()
+    if sameID(appliedID, id) {
+      return OK
+    }
+    return ErrWrongCoordinator
+  }
+
+  ch := make(chan Err, 1)
+  group.waiters[index] = pendingPut{id: id, ch: ch}
+  group.mu.Unlock()
+
+  return <-ch
+}
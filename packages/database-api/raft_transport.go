@@ -0,0 +1,66 @@
+package main
+
+import (
+  "crypto/sha1"
+  "encoding/hex"
+  "io/ioutil"
+  "log"
+)
+
+// raftRPCClient adapts this package's call() helper to raft.RPCClient,
+// so Raft groups reach their peers over the same net/rpc connections
+// MMDatabase itself uses.
+type raftRPCClient struct{}
+
+func (raftRPCClient) Call(peer string, method string, args interface{}, reply interface{}) bool {
+  return call(peer, method, args, reply)
+}
+
+// filePersister implements raft.Persister by writing state and
+// snapshot bytes to two files named after the group, so a crashed
+// group member recovers its term, vote and log instead of silently
+// re-electing from scratch.
+type filePersister struct {
+  statePath string
+  snapshotPath string
+}
+
+// newFilePersister derives its file names from a hash of groupID rather
+// than groupID itself, since groupID is a comma-joined list of unix
+// socket paths and using it directly would embed stray "/" separators
+// into the file name.
+func newFilePersister(groupID string) *filePersister {
+  sum := sha1.Sum([]byte(groupID))
+  name := hex.EncodeToString(sum[:])
+  return &filePersister{
+    statePath: name + ".raftstate",
+    snapshotPath: name + ".snapshot",
+  }
+}
+
+func (p *filePersister) SaveState(raftState []byte, snapshot []byte) {
+  if err := ioutil.WriteFile(p.statePath, raftState, 0600); err != nil {
+    log.Printf("filePersister: write %s: %v", p.statePath, err)
+  }
+  if snapshot != nil {
+    if err := ioutil.WriteFile(p.snapshotPath, snapshot, 0600); err != nil {
+      log.Printf("filePersister: write %s: %v", p.snapshotPath, err)
+    }
+  }
+}
+
+func (p *filePersister) ReadRaftState() []byte {
+  data, err := ioutil.ReadFile(p.statePath)
+  if err != nil {
+    return nil
+  }
+  return data
+}
+
+func (p *filePersister) ReadSnapshot() []byte {
+  data, err := ioutil.ReadFile(p.snapshotPath)
+  if err != nil {
+    return nil
+  }
+  return data
+}
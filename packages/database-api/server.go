@@ -7,12 +7,14 @@ import "log"
 import "sync"
 import "os"
 import "syscall"
-import "math/rand"
+import mrand "math/rand"
 import "time"
-import "hash/fnv"
 import "math/big"
 import "crypto/rand"
 
+import "github.com/jmoldow/MylarMail/packages/hashring"
+import "github.com/jmoldow/MylarMail/packages/shardctrler"
+
 const (
   OK = "OK"
   ErrWrongCoordinator = "ErrWrongCoordinator"
@@ -40,18 +42,49 @@ type MMDatabase struct {
   unreliable bool // for testing
   servers []string
   nServers int
+  ring *hashring.Ring // Consistent-hash ring mapping usernames to servers
+  virtualNodes int // Number of virtual nodes each server is given on the ring
   nReplicas int // Number of replicas wanted
-  handoffMessages []*Message // Messages that need to be handed off
+  R int // Number of replicas that must ack a read before it is returned
+  W int // Number of replicas that must ack a write before it is returned
+  handoffStore HandoffStore // Durable queue of messages that need to be handed off
+  handoffBackoff map[string]time.Duration // Per-destination backoff after a failed handoff delivery
+  store map[string][]*Message // Messages held locally, keyed by username
+  storeVersion int64 // Bumped on every local mutation; drives lazy Merkle tree rebuilds
+  merkleTree *MerkleTree // Cached Merkle tree over store, rebuilt lazily
+  merkleVersion int64 // storeVersion the cached merkleTree was built at
+  merkleFanout int // Number of children per Merkle tree node
+  merkleRebuildInterval time.Duration // Average interval between anti-entropy exchanges with a peer
+  rpcs *rpc.Server // Shared RPC server new Raft groups register themselves on
+  groups map[string]*raftGroup // Raft group per distinct preference list, keyed by groupIDFor
+  ctrlers []string // Addresses of the shardctrler cluster, if any
+  config shardctrler.Config // Most recently adopted shard assignment
+  migrating map[int]bool // Shards currently frozen for migration
+  clientTable map[int64]clientRecord // Per-client last-seen Seq and reply, for at-most-once Puts
+  clientTableStore *clientTableStore // Durably persists clientTable alongside store
+}
+
+// clientRecord is LocalPut's record of the last request it applied for
+// a given client, used to answer a retry without reapplying it.
+type clientRecord struct {
+  LastSeq int64
+  LastReply Err
 }
 
+// Message's fields are exported because Message crosses process
+// boundaries unchanged: it is carried inside ReplicaPutArgs,
+// ReplicaGetReply, the Raft putCommand, and ShardMigrateArgs, all of
+// which net/rpc marshals with encoding/gob, and gob refuses to encode a
+// struct with no exported fields.
 type Message struct {
-  id MessageID
+  ID MessageID
+  Clock VectorClock
   // Whether or not this message needs to be handed off to another node later
-  isHandoff bool
-  handoffDestination string
-  handoffUsername string
-  data string
-  collection string
+  IsHandoff bool
+  HandoffDestination string
+  HandoffUsername string
+  Data string
+  Collection string
 }
 
 /*
@@ -60,77 +93,119 @@ API from Mylar/Meteor
 ****************************************************
 */
 
-// Returns an ordered slice of servers in order they should be considered as coordinator
+// Returns the nReplicas servers (coordinator first) that should hold
+// username's messages, walking the consistent-hash ring clockwise from
+// hash(username).
 func (db *MMDatabase) GetCoordinatorList(username string) []string {
-  initialIndex := db.getCoordinatorIndex(username)
-  output := make([]string, 0)
-  
-  for i := initialIndex; i < len(db.servers); i++ {
-    output = append(output, db.servers[i])
-  }
-  
-  for i := 0; i < initialIndex; i++ {
-    output = append(output, db.servers[i])
-  }
-  
-  return output
+  db.mu.Lock()
+  defer db.mu.Unlock()
+
+  return db.ring.Preference(username, db.nReplicas)
+}
+
+// Returns true if this node is the first entry of username's preference
+// list, i.e. the node responsible for coordinating its reads/writes.
+func (db *MMDatabase) isCoordinator(username string) bool {
+  prefList := db.GetCoordinatorList(username)
+  return len(prefList) > 0 && prefList[0] == db.servers[db.me]
 }
 
 // Returns success once nReplicas replicas are stored in the system
+// CoordinatorPut submits message to username's Raft group and waits
+// for it to come back out of the apply channel, which guarantees every
+// member of the group applies puts in the same order instead of racing
+// independent ReplicaPut calls. The old best-effort quorum fan-out and
+// its hinted handoff are superseded for in-group replication; ReplicaPut
+// and the handoff queue remain for cross-group forwarding.
 func (db *MMDatabase) CoordinatorPut(username string, id RequestID, message Message) Err {
-  // Assert that this should be coordinator
-  if db.getCoordinatorIndex(username) != db.me && !message.isHandoff {
+  db.mu.Lock()
+  frozen := db.migrating[int(hash(username))%shardctrler.NShards]
+  db.mu.Unlock()
+  if frozen {
     return ErrWrongCoordinator
   }
-  
-  totalReplicas := 0
-  replicaLocations := make(map[int]bool)
-  handoffTargets := make(map[int]bool)
-  
-  // Send to all N replicas except for this one (the coordinator)
-  for totalReplicas < db.nReplicas-1 {
-    for i, server := range(db.GetCoordinatorList(username)) {
-      if !replicaLocations[i] && i != db.me {
-        // Set Hinted Handoff
-        handoffTarget := db.getHandoffTarget(username, i, replicaLocations, handoffTargets)
-        if handoffTarget == -1 {
-          message.isHandoff = false
-        } else {
-          message.isHandoff = true
-          message.handoffDestination = db.servers[i]
-          message.handoffUsername = username
-          handoffTargets[handoffTarget] = true
-        }
-        // Set up args and reply
-        args := new(ReplicaPutArgs)
-        reply := new(ReplicaPutReply)
-        args.Username = username
-        args.Msg = message
-        args.Handoff = false
-        
-        ok := call(server, "MMDatabase.ReplicaPut", args, reply)
-      
-        if ok && reply.Err == OK {
-          totalReplicas++
-          replicaLocations[i] = true
-        }
-      }
-      
-      if totalReplicas >=  db.nReplicas {
-        break
-      }
-      
+
+  group := db.groupFor(username)
+  if group == nil {
+    return ErrWrongCoordinator
+  }
+
+  index, _, isLeader := group.rf.Start(putCommand{Username: username, Msg: message, ID: id})
+  if !isLeader {
+    return ErrWrongCoordinator
+  }
+
+  return group.waitFor(index, id)
+}
+
+// Returns the reconciled set of messages for username once R replicas
+// have responded, performing read repair on any replica found to be
+// stale or missing a message.
+func (db *MMDatabase) CoordinatorGet(username string, id RequestID) ([]Message, Err) {
+  if !db.isCoordinator(username) {
+    return nil, ErrWrongCoordinator
+  }
+
+  prefList := db.GetCoordinatorList(username)
+  responses := make([]replicaResponse, 0, db.R)
+  responses = append(responses, replicaResponse{db.servers[db.me], db.LocalGet(username)})
+
+  for _, server := range prefList {
+    if len(responses) >= db.R {
+      break
+    }
+    if server == db.servers[db.me] {
+      continue
+    }
+
+    args := &ReplicaGetArgs{Username: username}
+    reply := new(ReplicaGetReply)
+    ok := call(server, "MMDatabase.ReplicaGet", args, reply)
+
+    if ok && reply.Err == OK {
+      responses = append(responses, replicaResponse{server, reply.Messages})
     }
   }
-  
-  // There should now be (at least) nReplicas-1 replicas in the system.
-  // Replicate at the N-th server (this one / the coordinator),
-  // then return success.
-  db.LocalPut(username, message)
-  totalReplicas++
-  replicaLocations[db.me] = true
-  
-  return OK
+
+  if len(responses) < db.R {
+    return nil, ErrWrongCoordinator
+  }
+
+  reconciled := reconcile(responses)
+  go db.readRepair(username, responses, reconciled)
+
+  return reconciled, OK
+}
+
+// CoordinatorPutArgs/Reply and GetCoordinatorListArgs/Reply let a Clerk
+// drive CoordinatorPut and GetCoordinatorList over RPC instead of
+// linking against MMDatabase directly.
+type CoordinatorPutArgs struct {
+  Username string
+  ID RequestID
+  Msg Message
+}
+
+type CoordinatorPutReply struct {
+  Err Err
+}
+
+func (db *MMDatabase) CoordinatorPutRPC(args *CoordinatorPutArgs, reply *CoordinatorPutReply) error {
+  reply.Err = db.CoordinatorPut(args.Username, args.ID, args.Msg)
+  return nil
+}
+
+type GetCoordinatorListArgs struct {
+  Username string
+}
+
+type GetCoordinatorListReply struct {
+  Servers []string
+}
+
+func (db *MMDatabase) GetCoordinatorListRPC(args *GetCoordinatorListArgs, reply *GetCoordinatorListReply) error {
+  reply.Servers = db.GetCoordinatorList(args.Username)
+  return nil
 }
 
 /*
@@ -139,9 +214,64 @@ API to Mylar/Meteor
 ****************************************************
 */
 
-func (db *MMDatabase) LocalPut(username string, msg Message) Err {
-  // TODO
-  return OK
+// LocalPut applies msg to this node's store. When id is non-zero (a
+// real client request, as opposed to an internal replication path
+// like read repair, anti-entropy, or shard migration) it is idempotent
+// w.r.t. (id.ClientID, id.Seq): a retried Put with a Seq this node has
+// already seen for that client is skipped and the cached reply from
+// the first attempt is returned, instead of storing the message twice.
+func (db *MMDatabase) LocalPut(username string, msg Message, id RequestID) Err {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+
+  if id.ClientID != 0 {
+    if record, ok := db.clientTable[id.ClientID]; ok && id.Seq <= record.LastSeq {
+      return record.LastReply
+    }
+  }
+
+  db.storeVersion++
+
+  existing := db.store[username]
+  var applied Err = OK
+  stored := false
+  for i, s := range existing {
+    if s.ID == msg.ID {
+      msg.Clock = mergeClocks(msg.Clock, s.Clock)
+      msg.Clock[db.me]++
+      existing[i] = &msg
+      stored = true
+      break
+    }
+  }
+
+  if !stored {
+    if msg.Clock == nil {
+      msg.Clock = make(VectorClock)
+    }
+    msg.Clock[db.me]++
+    db.store[username] = append(existing, &msg)
+  }
+
+  if id.ClientID != 0 {
+    db.clientTable[id.ClientID] = clientRecord{LastSeq: id.Seq, LastReply: applied}
+    db.clientTableStore.Save(db.clientTable)
+  }
+
+  return applied
+}
+
+// Returns a copy of every message currently held locally for username.
+func (db *MMDatabase) LocalGet(username string) []Message {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+
+  stored := db.store[username]
+  out := make([]Message, len(stored))
+  for i, msg := range stored {
+    out[i] = *msg
+  }
+  return out
 }
 
 func (db *MMDatabase) LocalDelete(username string, id MessageID) Err {
@@ -159,16 +289,61 @@ func (db *MMDatabase) ReplicaPut(args *ReplicaPutArgs, reply *ReplicaPutReply) e
   message := args.Msg
   // if message is satisfying a handoff, mark it as not needing handoff
   if args.Handoff {
-    message.isHandoff = false
+    message.IsHandoff = false
+    db.LocalPut(args.Username, message, args.ID)
+    reply.Err = OK
+    return nil
+  }
+
+  // This node's ring membership may have changed since the sender
+  // computed args.Username's preference list (e.g. a config change
+  // mid-flight); if this node is no longer actually one of its
+  // replicas, hand the write off to one that is instead of storing it
+  // under a username it doesn't own.
+  if !db.isMember(args.Username) {
+    target := db.forwardTarget(args.Username)
+    if target == "" {
+      reply.Err = ErrWrongCoordinator
+      return nil
+    }
+    message.IsHandoff = true
+    message.HandoffDestination = target
+    message.HandoffUsername = args.Username
+    db.handoffStore.Enqueue(&message)
+    reply.Err = OK
+    return nil
+  }
+
+  db.LocalPut(args.Username, message, args.ID)
+  reply.Err = OK
+  return nil
+}
+
+// isMember reports whether this node currently appears in username's
+// preference list.
+func (db *MMDatabase) isMember(username string) bool {
+  for _, server := range db.GetCoordinatorList(username) {
+    if server == db.servers[db.me] {
+      return true
+    }
   }
-  
-  // Do Local Put
-  db.LocalPut(args.Username, message)
-  
-  // if message needs to be handed off, store in list of messages that need handing off
-  if message.isHandoff {
-    db.handoffMessages = append(db.handoffMessages, &message)
+  return false
+}
+
+// forwardTarget returns the current preference-list coordinator for
+// username, the node a misdirected ReplicaPut should be forwarded to.
+func (db *MMDatabase) forwardTarget(username string) string {
+  prefList := db.GetCoordinatorList(username)
+  if len(prefList) == 0 {
+    return ""
   }
+  return prefList[0]
+}
+
+// Serves a replica's view of username's messages to a coordinator
+// performing a quorum read.
+func (db *MMDatabase) ReplicaGet(args *ReplicaGetArgs, reply *ReplicaGetReply) error {
+  reply.Messages = db.LocalGet(args.Username)
   reply.Err = OK
   return nil
 }
@@ -179,79 +354,249 @@ API Helpers
 ****************************************************
 */
 
-// Returns a copy of slice without message at index
-func removeMessage(slice []*Message, index int) []*Message {
-  maxIndex := len(slice)-1
-  
-  lastElem := slice[maxIndex]
-  slice[maxIndex] = slice[index]
-  slice[index] = lastElem
-  
-  return slice[:maxIndex]
+// replicaResponse pairs a replica's address with the messages it
+// returned for a CoordinatorGet.
+type replicaResponse struct {
+  server string
+  messages []Message
+}
+
+// reconcile merges the message lists returned by several replicas,
+// keeping, for each message id, only the versions whose vector clock is
+// not strictly dominated by another version's (i.e. dropping anything
+// that is known to be stale).
+func reconcile(responses []replicaResponse) []Message {
+  byID := make(map[MessageID][]Message)
+  for _, resp := range responses {
+    for _, msg := range resp.messages {
+      byID[msg.ID] = append(byID[msg.ID], msg)
+    }
+  }
+
+  out := make([]Message, 0, len(byID))
+  for _, versions := range byID {
+    out = append(out, latestVersions(versions)...)
+  }
+  return out
+}
+
+// latestVersions drops any message whose vector clock is strictly
+// dominated by another's, leaving true conflicts (concurrent siblings)
+// in place. Two versions with identical clocks (the common case: every
+// healthy replica agreeing) are the same version, not siblings, so only
+// the first copy is kept even though neither dominates the other.
+func latestVersions(versions []Message) []Message {
+  keep := make([]bool, len(versions))
+  for i := range versions {
+    keep[i] = true
+  }
+
+  for i, a := range versions {
+    for j, b := range versions {
+      if i == j || !keep[i] || !keep[j] {
+        continue
+      }
+      if a.Clock.dominates(b.Clock) {
+        keep[j] = false
+      } else if i < j && clocksEqual(a.Clock, b.Clock) {
+        keep[j] = false
+      }
+    }
+  }
+
+  out := make([]Message, 0, len(versions))
+  for i, msg := range versions {
+    if keep[i] {
+      out = append(out, msg)
+    }
+  }
+  return out
 }
 
+// readRepair asynchronously pushes the reconciled version of each
+// message to any replica whose response was missing it or held a
+// stale copy.
+func (db *MMDatabase) readRepair(username string, responses []replicaResponse, reconciled []Message) {
+  for _, resp := range responses {
+    if resp.server == db.servers[db.me] {
+      continue
+    }
+
+    seen := make(map[MessageID]VectorClock)
+    for _, msg := range resp.messages {
+      seen[msg.ID] = msg.Clock
+    }
+
+    for _, latest := range reconciled {
+      clock, ok := seen[latest.ID]
+      if ok && !latest.Clock.dominates(clock) {
+        continue
+      }
+
+      args := &ReplicaPutArgs{Username: username, Msg: latest}
+      reply := new(ReplicaPutReply)
+      call(resp.server, "MMDatabase.ReplicaPut", args, reply)
+    }
+  }
+}
+
+// mergeClocks returns the element-wise maximum of two vector clocks.
+func mergeClocks(a, b VectorClock) VectorClock {
+  out := make(VectorClock)
+  for server, count := range a {
+    out[server] = count
+  }
+  for server, count := range b {
+    if count > out[server] {
+      out[server] = count
+    }
+  }
+  return out
+}
+
+// dominates reports whether clock a is greater than or equal to b in
+// every component, and strictly greater in at least one, meaning b is
+// stale with respect to a.
+func (a VectorClock) dominates(b VectorClock) bool {
+  strictlyGreater := false
+
+  for server, count := range b {
+    if a[server] < count {
+      return false
+    }
+  }
+  for server, count := range a {
+    if count > b[server] {
+      strictlyGreater = true
+    }
+  }
+
+  return strictlyGreater
+}
+
+// clocksEqual reports whether a and b have the same count for every
+// server either one has a nonzero entry for.
+func clocksEqual(a, b VectorClock) bool {
+  for server, count := range a {
+    if b[server] != count {
+      return false
+    }
+  }
+  for server, count := range b {
+    if a[server] != count {
+      return false
+    }
+  }
+  return true
+}
+
+const minHandoffBackoff = 100 * time.Millisecond
+const maxHandoffBackoff = 30 * time.Second
+
 func (db *MMDatabase) runHandoffLoop() {
+  // When delivery to each destination was last attempted; a destination
+  // still inside its backoff is skipped rather than slept on.
+  lastAttempt := make(map[string]time.Time)
   for !db.dead {
-    for i, message := range db.handoffMessages {
+    delivered := false
+
+    iter := db.handoffStore.Iter()
+    for {
+      seq, message, ok := iter.Next()
+      if !ok {
+        break
+      }
+
+      db.mu.Lock()
+      wait := db.handoffBackoff[message.HandoffDestination]
+      db.mu.Unlock()
+      if wait > 0 && time.Since(lastAttempt[message.HandoffDestination]) < wait {
+        continue
+      }
+
       // Set up args and reply
       args := new(ReplicaPutArgs)
       reply := new(ReplicaPutReply)
-      args.Username = message.handoffUsername
+      args.Username = message.HandoffUsername
       args.Msg = *message
       args.Handoff = true
-        
-      ok := call(message.handoffDestination, "MMDatabase.ReplicaPut", args, reply)
-      
-      if ok && reply.Err == OK {
-        // Handoff successful, delete message
-        db.handoffMessages = removeMessage(db.handoffMessages, i)
-        break
+
+      rpcOK := call(message.HandoffDestination, "MMDatabase.ReplicaPut", args, reply)
+      lastAttempt[message.HandoffDestination] = time.Now()
+
+      db.mu.Lock()
+      if rpcOK && reply.Err == OK {
+        delete(db.handoffBackoff, message.HandoffDestination)
       } else {
-        time.Sleep(1000*time.Millisecond)
+        db.handoffBackoff[message.HandoffDestination] = nextHandoffBackoff(wait)
+      }
+      db.mu.Unlock()
+
+      if rpcOK && reply.Err == OK {
+        db.handoffStore.Ack(seq)
+        delivered = true
       }
     }
-  }
-}
 
-// Returns index of first server that should be chosen as coordinator
-func (db *MMDatabase) getCoordinatorIndex(username string) int {
-  return int(hash(username) % uint32(db.nServers))
+    if !delivered {
+      time.Sleep(minHandoffBackoff)
+    }
+  }
 }
 
-// Returns what the current handoff target should be with respect to replicaLocations
-// Returns -1 if no handoff
-// Assumes currentIndex is in range [0,nReplicas-1]
-func (db *MMDatabase) getHandoffTarget(username string, currentIndex int, replicaLocations map[int]bool, handoffTargets map[int]bool) int {
-  wrap := false
-  firstReplica := db.getCoordinatorIndex(username)
-  lastReplica := firstReplica + db.nReplicas
-  if lastReplica >= db.nServers {
-    wrap = true
-    lastReplica = lastReplica % db.nServers
+// nextHandoffBackoff doubles the previous per-destination backoff,
+// starting from minHandoffBackoff and capping at maxHandoffBackoff, so
+// one dead destination doesn't stall delivery to every other one.
+func nextHandoffBackoff(previous time.Duration) time.Duration {
+  if previous == 0 {
+    return minHandoffBackoff
   }
-  
-  // Return -1 if in proper range
-  if wrap {
-    if currentIndex >= firstReplica || currentIndex <= lastReplica {
-      return -1
-    }
-  } else {
-    if firstReplica <= currentIndex && currentIndex <= lastReplica {
-      return -1
-    }
+
+  next := previous * 2
+  if next > maxHandoffBackoff {
+    next = maxHandoffBackoff
   }
-  
-  // Otherwise, target first one on priority list with no replica or targeted handoff yet
-  i := firstReplica
-  for {
-    if !replicaLocations[i] && !handoffTargets[i] {
-      return i
-    }
-    i++
-    if i >= db.nServers {
-      i = i % db.nServers
+  return next
+}
+
+// SetShardControllers points this node at the shardctrler cluster
+// responsible for assigning shards to groups. runConfigPollLoop picks
+// up the change on its next poll.
+func (db *MMDatabase) SetShardControllers(ctrlers []string) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+  db.ctrlers = ctrlers
+}
+
+// AddNode registers server's virtual nodes on the ring, so that it
+// begins taking responsibility for a share of the keyspace. Only the
+// keys between its new virtual nodes and their successors move; every
+// other mapping is left untouched.
+func (db *MMDatabase) AddNode(server string) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+
+  db.ring.AddNode(server)
+  db.servers = append(db.servers, server)
+  db.nServers = len(db.servers)
+}
+
+// RemoveNode strips server's virtual nodes from the ring, so that the
+// keys it used to own fall to the next server clockwise.
+func (db *MMDatabase) RemoveNode(server string) {
+  db.mu.Lock()
+  defer db.mu.Unlock()
+
+  db.ring.RemoveNode(server)
+
+  remaining := db.servers[:0]
+  for _, s := range db.servers {
+    if s != server {
+      remaining = append(remaining, s)
     }
   }
+  db.servers = remaining
+  db.nServers = len(db.servers)
 }
 
 /*
@@ -261,14 +606,14 @@ API Dispatch Methods
 */
 
 // Serves RPC calls from other database instances
-func serveRPC() {
+func (db *MMDatabase) serveRPC() {
   for db.dead == false {
     conn, err := db.l.Accept()
     if err == nil && db.dead == false {
-      if db.unreliable && (rand.Int63() % 1000) < 100 {
+      if db.unreliable && (mrand.Int63() % 1000) < 100 {
         // discard the request.
         conn.Close()
-      } else if db.unreliable && (rand.Int63() % 1000) < 200 {
+      } else if db.unreliable && (mrand.Int63() % 1000) < 200 {
         // process the request but force discard of reply.
         c1 := conn.(*net.UnixConn)
         f, _ := c1.File()
@@ -276,15 +621,15 @@ func serveRPC() {
         if err != nil {
           fmt.Printf("shutdown: %v\n", err)
         }
-        go rpcs.ServeConn(conn)
+        go db.rpcs.ServeConn(conn)
       } else {
-        go rpcs.ServeConn(conn)
+        go db.rpcs.ServeConn(conn)
       }
     } else if err == nil {
       conn.Close()
     }
     if err != nil && db.dead == false {
-      fmt.Printf("MMDatabase(%v) accept: %v\n", me, err.Error())
+      fmt.Printf("MMDatabase(%v) accept: %v\n", db.me, err.Error())
       db.kill()
     }
   }
@@ -296,16 +641,6 @@ Helper Functions
 ****************************************************
 */
 
-func sameID(id1 RequestID, id2 RequestID) bool {
-  return id1.ClientID == id2.ClientID && id1.Seq == id2.Seq
-}
-
-func hash(s string) uint32 {
-  h := fnv.New32a()
-  h.Write([]byte(s))
-  return h.Sum32()
-}
-
 func nrand() int64 {
   max := big.NewInt(int64(1) << 62)
   bigx, _ := rand.Int(rand.Reader, max)
@@ -313,28 +648,18 @@ func nrand() int64 {
   return x
 }
 
-/*
-****************************************************
-Helper Data Types
-****************************************************
-*/
-
-type Err string
-
-type ReplicaPutArgs struct {
-  Username string
-  Msg Message
-  // Whether this ReplicaPut call is satisfying a Handoff (as opposed to being in top nReplicas of priority list)
-  Handoff bool
-}
-
-type ReplicaPutReply struct {
-  Err Err
-}
+// call dials srv (a unix socket path, as used throughout this package)
+// and invokes rpcname, returning false on any dial or RPC error instead
+// of propagating it, since every caller already treats an unreachable
+// or failing peer as "try again later" rather than a fatal condition.
+func call(srv string, rpcname string, args interface{}, reply interface{}) bool {
+  c, err := rpc.Dial("unix", srv)
+  if err != nil {
+    return false
+  }
+  defer c.Close()
 
-type RequestID struct {
-  ClientID int64
-  Seq int64
+  return c.Call(rpcname, args, reply) == nil
 }
 
 /*
@@ -357,6 +682,18 @@ func (db *MMDatabase) kill() {
 // me is the index of the current server in servers[].
 // 
 func StartServer(servers []string, me int) *MMDatabase {
+  handoffStore, err := newFileHandoffStore(servers[me] + ".handoff")
+  if err != nil {
+    log.Fatal("failed to open handoff store: ", err)
+  }
+
+  return StartServerWithHandoffStore(servers, me, handoffStore)
+}
+
+// StartServerWithHandoffStore is StartServer with the hinted-handoff
+// queue implementation made explicit, so tests can inject an in-memory
+// or fake HandoffStore instead of the durable on-disk default.
+func StartServerWithHandoffStore(servers []string, me int, handoffStore HandoffStore) *MMDatabase {
   // call gob.Register on structures you want
   // Go's RPC library to marshall/unmarshall.
 
@@ -365,14 +702,32 @@ func StartServer(servers []string, me int) *MMDatabase {
   db.me = me
   db.servers = servers
   db.nServers = len(servers)
+  db.virtualNodes = hashring.DefaultVirtualNodes
+  db.ring = hashring.New(db.virtualNodes)
+  for _, server := range servers {
+    db.ring.AddNode(server)
+  }
   db.nReplicas = 3
-  db.handoffMessages = make([]*Message, 0)
-  db.id = nrand()
+  db.R = 2
+  db.W = 2 // R+W > nReplicas, so every read overlaps every write
+  db.handoffStore = handoffStore
+  db.handoffBackoff = make(map[string]time.Duration)
+  db.store = make(map[string][]*Message)
+  db.merkleFanout = 16
+  db.merkleRebuildInterval = 10 * time.Second
+  db.groups = make(map[string]*raftGroup)
+  db.config = shardctrler.Config{Groups: make(map[int][]string)}
+  db.migrating = make(map[int]bool)
+  db.clientTableStore = newClientTableStore(servers[me] + ".clients.db")
+  db.clientTable = db.clientTableStore.Load()
 
   go db.runHandoffLoop()
+  go db.runAntiEntropyLoop()
+  go db.runConfigPollLoop()
 
   rpcs := rpc.NewServer()
   rpcs.Register(db)
+  db.rpcs = rpcs
 
   os.Remove(servers[me])
   l, e := net.Listen("unix", servers[me]);
@@ -385,7 +740,7 @@ func StartServer(servers []string, me int) *MMDatabase {
   // please do not change any of the following code,
   // or do anything to subvert it.
 
-  go serveRPC()
+  go db.serveRPC()
 
   return db
 }
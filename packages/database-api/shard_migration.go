@@ -0,0 +1,152 @@
+package main
+
+import (
+  "time"
+
+  "github.com/jmoldow/MylarMail/packages/shardctrler"
+)
+
+const configPollInterval = 200 * time.Millisecond
+const migrateMinBackoff = 100 * time.Millisecond
+const migrateMaxBackoff = 5 * time.Second
+
+// ShardMigrateArgs carries every (username, messages) pair a source
+// group is handing off for shard, as decided by a shardctrler.Config
+// move.
+type ShardMigrateArgs struct {
+  Shard int
+  ConfigNum int
+  Messages map[string][]*Message
+}
+
+type ShardMigrateReply struct {
+  Err Err
+}
+
+// ShardMigrate installs messages being handed off by the group that
+// used to own Shard, so this node (now part of the owning group) has
+// them before the sender unfreezes the shard.
+func (db *MMDatabase) ShardMigrate(args *ShardMigrateArgs, reply *ShardMigrateReply) error {
+  for username, msgs := range args.Messages {
+    for _, msg := range msgs {
+      db.LocalPut(username, *msg, RequestID{})
+    }
+  }
+  reply.Err = OK
+  return nil
+}
+
+// runConfigPollLoop keeps this node's view of shard ownership current
+// by polling the shard controller. A config that moves a shard away
+// from this node's group is applied only after that shard's data has
+// been migrated to its new owner.
+func (db *MMDatabase) runConfigPollLoop() {
+  for !db.dead {
+    if len(db.ctrlers) > 0 {
+      if next, ok := db.queryLatestConfig(); ok && next.Num > db.config.Num {
+        db.applyConfig(next)
+      }
+    }
+    time.Sleep(configPollInterval)
+  }
+}
+
+func (db *MMDatabase) queryLatestConfig() (shardctrler.Config, bool) {
+  args := &shardctrler.QueryArgs{Num: -1}
+  for _, ctrler := range db.ctrlers {
+    reply := new(shardctrler.QueryReply)
+    if call(ctrler, "ShardCtrler.Query", args, reply) && reply.Err == shardctrler.OK {
+      return reply.Config, true
+    }
+  }
+  return shardctrler.Config{}, false
+}
+
+// myGID returns the group id cfg assigns to this node, or 0 if this
+// node isn't listed in any of cfg's groups.
+func (db *MMDatabase) myGID(cfg shardctrler.Config) int {
+  me := db.servers[db.me]
+  for gid, members := range cfg.Groups {
+    for _, server := range members {
+      if server == me {
+        return gid
+      }
+    }
+  }
+  return 0
+}
+
+// applyConfig migrates every shard that moved away from this node's
+// group between db.config and next, then adopts next.
+func (db *MMDatabase) applyConfig(next shardctrler.Config) {
+  db.mu.Lock()
+  prev := db.config
+  myGID := db.myGID(prev)
+  db.mu.Unlock()
+
+  if myGID != 0 {
+    for shard := 0; shard < shardctrler.NShards; shard++ {
+      if prev.Shards[shard] == myGID && next.Shards[shard] != myGID {
+        db.migrateShard(shard, next)
+      }
+    }
+  }
+
+  db.mu.Lock()
+  db.config = next
+  db.mu.Unlock()
+}
+
+// migrateShard freezes writes for shard, ships every (username,
+// Message) pair it owns to the shard's new group, and only once a
+// quorum of that group has acked does it drop the shard locally. A
+// single ack isn't enough: until the rest of group B catches up via
+// anti-entropy, a crash of that one replica would lose the shard
+// outright, since the source has already deleted its own copy.
+func (db *MMDatabase) migrateShard(shard int, next shardctrler.Config) {
+  db.mu.Lock()
+  db.migrating[shard] = true
+  payload := make(map[string][]*Message)
+  for username, msgs := range db.store {
+    if int(hash(username))%shardctrler.NShards == shard {
+      payload[username] = msgs
+    }
+  }
+  db.mu.Unlock()
+
+  destGID := next.Shards[shard]
+  dest := next.Groups[destGID]
+  quorum := len(dest)/2 + 1
+  args := &ShardMigrateArgs{Shard: shard, ConfigNum: next.Num, Messages: payload}
+
+  backoff := migrateMinBackoff
+  for {
+    acked := 0
+    for _, server := range dest {
+      reply := new(ShardMigrateReply)
+      if call(server, "MMDatabase.ShardMigrate", args, reply) && reply.Err == OK {
+        acked++
+      }
+    }
+    if acked >= quorum {
+      break
+    }
+
+    // Fewer than a quorum of the destination group confirmed receipt;
+    // stay frozen and keep the shard locally rather than unfreezing
+    // onto data only a minority of group B has, and retry.
+    time.Sleep(backoff)
+    backoff *= 2
+    if backoff > migrateMaxBackoff {
+      backoff = migrateMaxBackoff
+    }
+  }
+
+  db.mu.Lock()
+  db.storeVersion++
+  for username := range payload {
+    delete(db.store, username)
+  }
+  delete(db.migrating, shard)
+  db.mu.Unlock()
+}
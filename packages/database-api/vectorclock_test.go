@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestMergeClocksTakesElementwiseMax(t *testing.T) {
+  a := VectorClock{1: 3, 2: 1}
+  b := VectorClock{1: 2, 3: 5}
+
+  merged := mergeClocks(a, b)
+  want := VectorClock{1: 3, 2: 1, 3: 5}
+
+  if len(merged) != len(want) {
+    t.Fatalf("mergeClocks(%v, %v) = %v, want %v", a, b, merged, want)
+  }
+  for server, count := range want {
+    if merged[server] != count {
+      t.Errorf("mergeClocks(%v, %v)[%d] = %d, want %d", a, b, server, merged[server], count)
+    }
+  }
+}
+
+func TestMergeClocksDoesNotMutateInputs(t *testing.T) {
+  a := VectorClock{1: 1}
+  b := VectorClock{1: 2}
+
+  mergeClocks(a, b)
+
+  if a[1] != 1 || b[1] != 2 {
+    t.Fatalf("mergeClocks mutated an input: a=%v b=%v", a, b)
+  }
+}
+
+func TestDominatesStrictlyGreater(t *testing.T) {
+  a := VectorClock{1: 2, 2: 1}
+  b := VectorClock{1: 1, 2: 1}
+
+  if !a.dominates(b) {
+    t.Fatalf("%v.dominates(%v) = false, want true", a, b)
+  }
+  if b.dominates(a) {
+    t.Fatalf("%v.dominates(%v) = true, want false", b, a)
+  }
+}
+
+func TestDominatesEqualClocksIsFalse(t *testing.T) {
+  a := VectorClock{1: 2, 2: 1}
+  b := VectorClock{1: 2, 2: 1}
+
+  if a.dominates(b) {
+    t.Fatalf("%v.dominates(%v) = true, want false (clocks are equal, neither dominates)", a, b)
+  }
+}
+
+func TestDominatesConcurrentClocksIsFalse(t *testing.T) {
+  a := VectorClock{1: 2, 2: 0}
+  b := VectorClock{1: 0, 2: 2}
+
+  if a.dominates(b) || b.dominates(a) {
+    t.Fatalf("concurrent clocks %v, %v should not dominate each other", a, b)
+  }
+}
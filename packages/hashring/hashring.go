@@ -0,0 +1,111 @@
+// Package hashring implements a consistent-hash ring with virtual nodes,
+// used to map usernames to an ordered preference list of servers that is
+// stable across membership changes: adding or removing a server only
+// relocates the keys owned by its virtual nodes, rather than reshuffling
+// every user the way a plain hash % nServers scheme does.
+package hashring
+
+import (
+  "fmt"
+  "hash/fnv"
+  "sort"
+)
+
+// DefaultVirtualNodes is the number of ring positions each physical
+// server is given when no other value is configured.
+const DefaultVirtualNodes = 128
+
+type vnode struct {
+  token uint32
+  server string
+}
+
+// Ring is a consistent-hash ring of (token, server) pairs. It is not
+// safe for concurrent use; callers serialize access (e.g. MMDatabase
+// does so under its own mutex).
+type Ring struct {
+  virtualNodes int
+  vnodes []vnode // kept sorted by token
+}
+
+// New returns an empty ring where each server added will be given
+// virtualNodes positions. A non-positive virtualNodes falls back to
+// DefaultVirtualNodes.
+func New(virtualNodes int) *Ring {
+  if virtualNodes <= 0 {
+    virtualNodes = DefaultVirtualNodes
+  }
+  return &Ring{virtualNodes: virtualNodes}
+}
+
+func tokenFor(s string) uint32 {
+  h := fnv.New32a()
+  h.Write([]byte(s))
+  return h.Sum32()
+}
+
+// AddNode gives server virtualNodes positions on the ring. Adding a
+// server that is already present first removes its existing positions,
+// so AddNode is safe to use to re-add a node.
+func (r *Ring) AddNode(server string) {
+  r.RemoveNode(server)
+
+  for v := 0; v < r.virtualNodes; v++ {
+    token := tokenFor(fmt.Sprintf("%s-v%d", server, v))
+    r.vnodes = append(r.vnodes, vnode{token: token, server: server})
+  }
+
+  sort.Slice(r.vnodes, func(i, j int) bool {
+    return r.vnodes[i].token < r.vnodes[j].token
+  })
+}
+
+// RemoveNode strips every virtual node belonging to server from the
+// ring.
+func (r *Ring) RemoveNode(server string) {
+  remaining := r.vnodes[:0]
+  for _, vn := range r.vnodes {
+    if vn.server != server {
+      remaining = append(remaining, vn)
+    }
+  }
+  r.vnodes = remaining
+}
+
+// Preference walks the ring clockwise starting from hash(key) and
+// returns the first n distinct physical servers encountered, skipping
+// repeated virtual nodes of a server already chosen. Fewer than n
+// servers are returned if the ring has fewer than n distinct members.
+func (r *Ring) Preference(key string, n int) []string {
+  if len(r.vnodes) == 0 || n <= 0 {
+    return nil
+  }
+
+  token := tokenFor(key)
+  start := sort.Search(len(r.vnodes), func(i int) bool {
+    return r.vnodes[i].token >= token
+  })
+
+  seen := make(map[string]bool)
+  out := make([]string, 0, n)
+  for i := 0; i < len(r.vnodes) && len(out) < n; i++ {
+    vn := r.vnodes[(start+i)%len(r.vnodes)]
+    if seen[vn.server] {
+      continue
+    }
+    seen[vn.server] = true
+    out = append(out, vn.server)
+  }
+
+  return out
+}
+
+// NumServers returns the number of distinct physical servers currently
+// on the ring.
+func (r *Ring) NumServers() int {
+  seen := make(map[string]bool)
+  for _, vn := range r.vnodes {
+    seen[vn.server] = true
+  }
+  return len(seen)
+}
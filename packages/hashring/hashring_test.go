@@ -0,0 +1,86 @@
+package hashring
+
+import "testing"
+
+func TestPreferenceDistinctAndStable(t *testing.T) {
+  r := New(16)
+  r.AddNode("a")
+  r.AddNode("b")
+  r.AddNode("c")
+
+  pref := r.Preference("alice", 3)
+  if len(pref) != 3 {
+    t.Fatalf("Preference returned %d servers, want 3", len(pref))
+  }
+
+  seen := make(map[string]bool)
+  for _, server := range pref {
+    if seen[server] {
+      t.Fatalf("Preference returned %q twice: %v", server, pref)
+    }
+    seen[server] = true
+  }
+
+  again := r.Preference("alice", 3)
+  for i, server := range again {
+    if server != pref[i] {
+      t.Fatalf("Preference not stable across calls: got %v then %v", pref, again)
+    }
+  }
+}
+
+func TestPreferenceFewerThanNServers(t *testing.T) {
+  r := New(16)
+  r.AddNode("a")
+  r.AddNode("b")
+
+  pref := r.Preference("alice", 5)
+  if len(pref) != 2 {
+    t.Fatalf("Preference returned %d servers, want 2 (all of them)", len(pref))
+  }
+}
+
+func TestPreferenceEmptyRing(t *testing.T) {
+  r := New(16)
+  if pref := r.Preference("alice", 3); pref != nil {
+    t.Fatalf("Preference on empty ring = %v, want nil", pref)
+  }
+}
+
+func TestAddNodeIsIdempotent(t *testing.T) {
+  r := New(16)
+  r.AddNode("a")
+  before := r.NumServers()
+
+  r.AddNode("a")
+  if after := r.NumServers(); after != before {
+    t.Fatalf("re-adding a node changed NumServers: %d -> %d", before, after)
+  }
+}
+
+func TestRemoveNodeOnlyAffectsItsKeys(t *testing.T) {
+  r := New(16)
+  r.AddNode("a")
+  r.AddNode("b")
+  r.AddNode("c")
+
+  keys := []string{"alice", "bob", "carol", "dave", "erin"}
+  before := make(map[string][]string, len(keys))
+  for _, key := range keys {
+    before[key] = r.Preference(key, 1)
+  }
+
+  r.RemoveNode("c")
+  if got := r.NumServers(); got != 2 {
+    t.Fatalf("NumServers after RemoveNode = %d, want 2", got)
+  }
+
+  for _, key := range keys {
+    after := r.Preference(key, 1)
+    if len(before[key]) > 0 && before[key][0] != "c" {
+      if len(after) == 0 || after[0] != before[key][0] {
+        t.Errorf("removing an unrelated node moved %q: %v -> %v", key, before[key], after)
+      }
+    }
+  }
+}
@@ -0,0 +1,39 @@
+package raft
+
+import (
+  "bytes"
+  "encoding/gob"
+)
+
+// persistedState is the gob-encoded form of everything Raft must
+// survive a crash with.
+type persistedState struct {
+  CurrentTerm int
+  VotedFor int
+  Log []logEntry
+  LastIncludedIndex int
+  LastIncludedTerm int
+}
+
+func encodeRaftState(currentTerm, votedFor int, log []logEntry, lastIncludedIndex, lastIncludedTerm int) []byte {
+  var buf bytes.Buffer
+  state := persistedState{
+    CurrentTerm: currentTerm,
+    VotedFor: votedFor,
+    Log: log,
+    LastIncludedIndex: lastIncludedIndex,
+    LastIncludedTerm: lastIncludedTerm,
+  }
+  if err := gob.NewEncoder(&buf).Encode(state); err != nil {
+    return nil
+  }
+  return buf.Bytes()
+}
+
+func decodeRaftState(data []byte) (currentTerm, votedFor int, log []logEntry, lastIncludedIndex, lastIncludedTerm int, ok bool) {
+  var state persistedState
+  if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+    return 0, 0, nil, 0, 0, false
+  }
+  return state.CurrentTerm, state.VotedFor, state.Log, state.LastIncludedIndex, state.LastIncludedTerm, true
+}
@@ -0,0 +1,674 @@
+// Package raft implements a single Raft consensus group, modeled on the
+// MIT 6.824 raft lab: each peer runs leader election with randomized
+// timeouts, replicates a log of opaque commands via AppendEntries, and
+// delivers committed commands to the owner on ApplyMsg as they become
+// safe to apply. It does not own an RPC transport; callers supply one
+// via the RPCClient interface so the same package can sit on top of
+// net/rpc, labrpc, or a fake for tests.
+package raft
+
+import (
+  "math/rand"
+  "sync"
+  "time"
+)
+
+// ApplyMsg is sent on the channel passed to Make once the entry at
+// Index has been committed by a majority of the group and is safe to
+// apply to the owner's state machine. CommandValid is false for
+// messages that carry a snapshot instead of a log entry.
+type ApplyMsg struct {
+  CommandValid bool
+  Command interface{}
+  CommandIndex int
+
+  SnapshotValid bool
+  Snapshot []byte
+  SnapshotIndex int
+  SnapshotTerm int
+}
+
+// Persister is where a Raft instance saves the state it must survive a
+// crash: currentTerm, votedFor, the log, and (optionally) the latest
+// snapshot.
+type Persister interface {
+  SaveState(raftState []byte, snapshot []byte)
+  ReadRaftState() []byte
+  ReadSnapshot() []byte
+}
+
+// RPCClient lets Raft reach its peers without owning connections
+// itself; peer is an entry of the peers slice passed to Make.
+type RPCClient interface {
+  Call(peer string, method string, args interface{}, reply interface{}) bool
+}
+
+type role int
+
+const (
+  follower role = iota
+  candidate
+  leader
+)
+
+const (
+  minElectionTimeout = 300 * time.Millisecond
+  maxElectionTimeout = 600 * time.Millisecond
+  heartbeatInterval = 100 * time.Millisecond
+)
+
+// logEntry is one entry of the replicated log. Index is implicit in
+// its position within Raft.log, offset by lastIncludedIndex.
+type logEntry struct {
+  Term int
+  Command interface{}
+}
+
+// Raft is one member of a single consensus group.
+type Raft struct {
+  mu sync.Mutex
+  peers []string
+  me int
+  persister Persister
+  rpc RPCClient
+  applyCh chan ApplyMsg
+  // serviceName is the RPC service this group's methods are registered
+  // under; it lets several Raft groups share one rpc.Server instead of
+  // colliding on the type name "Raft".
+  serviceName string
+
+  // Persistent state, written via persist() before replying to RPCs or
+  // returning from Start.
+  currentTerm int
+  votedFor int
+  log []logEntry // log[0] is a sentinel; the first real entry is log[1]
+  lastIncludedIndex int
+  lastIncludedTerm int
+
+  // Volatile state.
+  role role
+  commitIndex int
+  lastApplied int
+  lastHeardFromLeader time.Time
+
+  // Volatile leader state, reset on each election win.
+  nextIndex []int
+  matchIndex []int
+
+  dead bool
+  applyCond *sync.Cond
+}
+
+// Make creates a Raft peer, restoring any persisted state, and starts
+// its election timer and apply loop in the background. peers must list
+// every group member in the same order on every peer; me is this
+// peer's index into peers. serviceName is the RPC service name this
+// peer's RequestVote/AppendEntries handlers are registered under on
+// every peer, so callers hosting multiple groups behind one RPC server
+// can tell their methods apart.
+func Make(peers []string, me int, persister Persister, rpc RPCClient, applyCh chan ApplyMsg, serviceName string) *Raft {
+  rf := &Raft{
+    peers: peers,
+    me: me,
+    persister: persister,
+    rpc: rpc,
+    applyCh: applyCh,
+    serviceName: serviceName,
+    role: follower,
+    votedFor: -1,
+    log: make([]logEntry, 1),
+  }
+  rf.applyCond = sync.NewCond(&rf.mu)
+
+  rf.readPersist(persister.ReadRaftState())
+  rf.lastHeardFromLeader = time.Now()
+
+  go rf.electionTimerLoop()
+  go rf.applyLoop()
+
+  return rf
+}
+
+// GetState returns this peer's current term and whether it believes
+// itself to be the group's leader.
+func (rf *Raft) GetState() (int, bool) {
+  rf.mu.Lock()
+  defer rf.mu.Unlock()
+  return rf.currentTerm, rf.role == leader
+}
+
+// Start asks the group to agree on command. It returns immediately; if
+// this peer is the leader, it returns the log index the command would
+// occupy once committed (there is no guarantee it will commit, e.g. if
+// this peer loses leadership first) along with the current term and
+// true. A non-leader returns false and the caller should retry against
+// another peer.
+func (rf *Raft) Start(command interface{}) (index int, term int, isLeader bool) {
+  rf.mu.Lock()
+  defer rf.mu.Unlock()
+
+  if rf.role != leader {
+    return -1, rf.currentTerm, false
+  }
+
+  rf.log = append(rf.log, logEntry{Term: rf.currentTerm, Command: command})
+  rf.persist()
+  index = rf.lastLogIndex()
+  term = rf.currentTerm
+  // A group of one has its majority already; nothing else would commit it.
+  rf.advanceCommitIndexLocked()
+
+  go rf.broadcastAppendEntries()
+
+  return index, term, true
+}
+
+// Kill stops this peer's background goroutines. A killed Raft is no
+// longer usable.
+func (rf *Raft) Kill() {
+  rf.mu.Lock()
+  rf.dead = true
+  rf.mu.Unlock()
+  rf.applyCond.Broadcast()
+}
+
+func (rf *Raft) killed() bool {
+  rf.mu.Lock()
+  defer rf.mu.Unlock()
+  return rf.dead
+}
+
+// Snapshot tells Raft that the owner has a snapshot of everything up
+// to and including index, so the log before it may be discarded.
+func (rf *Raft) Snapshot(index int, snapshot []byte) {
+  rf.mu.Lock()
+  defer rf.mu.Unlock()
+
+  if index <= rf.lastIncludedIndex || index > rf.lastLogIndex() {
+    return
+  }
+
+  rf.lastIncludedTerm = rf.entryAt(index).Term
+  rf.log = append([]logEntry{{}}, rf.log[rf.logPos(index)+1:]...)
+  rf.lastIncludedIndex = index
+  rf.persistWithSnapshot(snapshot)
+}
+
+/*
+****************************************************
+Log index bookkeeping (accounts for discarded prefix)
+****************************************************
+*/
+
+func (rf *Raft) lastLogIndex() int {
+  return rf.lastIncludedIndex + len(rf.log) - 1
+}
+
+func (rf *Raft) lastLogTerm() int {
+  if len(rf.log) > 1 {
+    return rf.log[len(rf.log)-1].Term
+  }
+  return rf.lastIncludedTerm
+}
+
+// logPos converts an absolute log index into a position in rf.log.
+func (rf *Raft) logPos(index int) int {
+  return index - rf.lastIncludedIndex
+}
+
+func (rf *Raft) entryAt(index int) logEntry {
+  return rf.log[rf.logPos(index)]
+}
+
+/*
+****************************************************
+Persistence
+****************************************************
+*/
+
+// persist gob-encodes currentTerm, votedFor and the log (see
+// encodeRaftState in persist.go) and saves them through the Persister,
+// together with whatever snapshot the Persister already holds.
+func (rf *Raft) persist() {
+  rf.persistWithSnapshot(rf.persister.ReadSnapshot())
+}
+
+func (rf *Raft) persistWithSnapshot(snapshot []byte) {
+  state := encodeRaftState(rf.currentTerm, rf.votedFor, rf.log, rf.lastIncludedIndex, rf.lastIncludedTerm)
+  rf.persister.SaveState(state, snapshot)
+}
+
+func (rf *Raft) readPersist(data []byte) {
+  if len(data) == 0 {
+    return
+  }
+
+  term, votedFor, log, lastIncludedIndex, lastIncludedTerm, ok := decodeRaftState(data)
+  if !ok {
+    return
+  }
+
+  rf.currentTerm = term
+  rf.votedFor = votedFor
+  rf.log = log
+  rf.lastIncludedIndex = lastIncludedIndex
+  rf.lastIncludedTerm = lastIncludedTerm
+  rf.commitIndex = lastIncludedIndex
+  rf.lastApplied = lastIncludedIndex
+}
+
+/*
+****************************************************
+RequestVote
+****************************************************
+*/
+
+type RequestVoteArgs struct {
+  Term int
+  CandidateID int
+  LastLogIndex int
+  LastLogTerm int
+}
+
+type RequestVoteReply struct {
+  Term int
+  VoteGranted bool
+}
+
+func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+  rf.mu.Lock()
+  defer rf.mu.Unlock()
+
+  if args.Term > rf.currentTerm {
+    rf.becomeFollowerLocked(args.Term)
+  }
+
+  reply.Term = rf.currentTerm
+  reply.VoteGranted = false
+
+  if args.Term < rf.currentTerm {
+    return nil
+  }
+
+  alreadyVoted := rf.votedFor != -1 && rf.votedFor != args.CandidateID
+  if alreadyVoted || !rf.candidateLogUpToDateLocked(args.LastLogIndex, args.LastLogTerm) {
+    return nil
+  }
+
+  rf.votedFor = args.CandidateID
+  rf.lastHeardFromLeader = time.Now()
+  rf.persist()
+  reply.VoteGranted = true
+
+  return nil
+}
+
+func (rf *Raft) candidateLogUpToDateLocked(lastLogIndex, lastLogTerm int) bool {
+  myLastTerm := rf.lastLogTerm()
+  if lastLogTerm != myLastTerm {
+    return lastLogTerm > myLastTerm
+  }
+  return lastLogIndex >= rf.lastLogIndex()
+}
+
+/*
+****************************************************
+AppendEntries
+****************************************************
+*/
+
+type AppendEntriesArgs struct {
+  Term int
+  LeaderID int
+  PrevLogIndex int
+  PrevLogTerm int
+  Entries []logEntry
+  LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+  Term int
+  Success bool
+  ConflictIndex int // first index the follower can offer for the leader to retry at
+  ConflictTerm int
+}
+
+func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+  rf.mu.Lock()
+  defer rf.mu.Unlock()
+
+  reply.Term = rf.currentTerm
+
+  if args.Term < rf.currentTerm {
+    reply.Success = false
+    return nil
+  }
+
+  if args.Term > rf.currentTerm || rf.role != follower {
+    rf.becomeFollowerLocked(args.Term)
+    reply.Term = rf.currentTerm
+  }
+  rf.lastHeardFromLeader = time.Now()
+
+  if args.PrevLogIndex > rf.lastLogIndex() {
+    reply.Success = false
+    reply.ConflictIndex = rf.lastLogIndex() + 1
+    return nil
+  }
+
+  if args.PrevLogIndex >= rf.lastIncludedIndex && rf.entryAt(args.PrevLogIndex).Term != args.PrevLogTerm {
+    reply.Success = false
+    reply.ConflictTerm = rf.entryAt(args.PrevLogIndex).Term
+    reply.ConflictIndex = rf.firstIndexOfTermLocked(reply.ConflictTerm)
+    return nil
+  }
+
+  for i, entry := range args.Entries {
+    index := args.PrevLogIndex + 1 + i
+    if index <= rf.lastLogIndex() && rf.entryAt(index).Term != entry.Term {
+      rf.log = rf.log[:rf.logPos(index)]
+    }
+    if index > rf.lastLogIndex() {
+      rf.log = append(rf.log, entry)
+    }
+  }
+  rf.persist()
+
+  if args.LeaderCommit > rf.commitIndex {
+    rf.commitIndex = min(args.LeaderCommit, rf.lastLogIndex())
+    rf.applyCond.Broadcast()
+  }
+
+  reply.Success = true
+  return nil
+}
+
+func (rf *Raft) firstIndexOfTermLocked(term int) int {
+  for i := rf.lastIncludedIndex + 1; i <= rf.lastLogIndex(); i++ {
+    if rf.entryAt(i).Term == term {
+      return i
+    }
+  }
+  return rf.lastIncludedIndex + 1
+}
+
+/*
+****************************************************
+Election
+****************************************************
+*/
+
+func (rf *Raft) electionTimerLoop() {
+  for !rf.killed() {
+    timeout := randomElectionTimeout()
+    time.Sleep(timeout)
+
+    rf.mu.Lock()
+    expired := rf.role != leader && time.Since(rf.lastHeardFromLeader) >= timeout
+    rf.mu.Unlock()
+
+    if expired {
+      go rf.startElection()
+    }
+  }
+}
+
+func randomElectionTimeout() time.Duration {
+  span := int64(maxElectionTimeout - minElectionTimeout)
+  return minElectionTimeout + time.Duration(rand.Int63n(span+1))
+}
+
+func (rf *Raft) startElection() {
+  rf.mu.Lock()
+  rf.becomeFollowerLocked(rf.currentTerm) // no-op on term, just resets vote bookkeeping below
+  rf.role = candidate
+  rf.currentTerm++
+  rf.votedFor = rf.me
+  rf.persist()
+  term := rf.currentTerm
+  args := &RequestVoteArgs{
+    Term: term,
+    CandidateID: rf.me,
+    LastLogIndex: rf.lastLogIndex(),
+    LastLogTerm: rf.lastLogTerm(),
+  }
+  rf.lastHeardFromLeader = time.Now()
+
+  votes := 1
+  var voteMu sync.Mutex
+  // A group of one has already won with its own vote; becomeLeaderLocked
+  // must run here, while rf.mu is still held, since the peer loop below
+  // never runs (it skips rf.me and has no other peers to range over) and
+  // so would otherwise never declare a winner.
+  done := votes*2 > len(rf.peers)
+  if done {
+    rf.becomeLeaderLocked()
+  }
+  rf.mu.Unlock()
+
+  if done {
+    return
+  }
+
+  for i := range rf.peers {
+    if i == rf.me {
+      continue
+    }
+
+    go func(peer int) {
+      reply := new(RequestVoteReply)
+      if !rf.rpc.Call(rf.peers[peer], rf.serviceName+".RequestVote", args, reply) {
+        return
+      }
+
+      rf.mu.Lock()
+      defer rf.mu.Unlock()
+
+      if reply.Term > rf.currentTerm {
+        rf.becomeFollowerLocked(reply.Term)
+        return
+      }
+      if rf.role != candidate || rf.currentTerm != term || !reply.VoteGranted {
+        return
+      }
+
+      voteMu.Lock()
+      votes++
+      won := !done && votes*2 > len(rf.peers)
+      if won {
+        done = true
+      }
+      voteMu.Unlock()
+
+      if won {
+        rf.becomeLeaderLocked()
+      }
+    }(i)
+  }
+}
+
+func (rf *Raft) becomeFollowerLocked(term int) {
+  if term > rf.currentTerm {
+    rf.currentTerm = term
+    rf.votedFor = -1
+    rf.persist()
+  }
+  rf.role = follower
+}
+
+// becomeLeaderLocked must be called with rf.mu held; it initializes
+// leader-only state and kicks off heartbeats.
+func (rf *Raft) becomeLeaderLocked() {
+  if rf.role != candidate {
+    return
+  }
+
+  rf.role = leader
+  rf.nextIndex = make([]int, len(rf.peers))
+  rf.matchIndex = make([]int, len(rf.peers))
+  for i := range rf.peers {
+    rf.nextIndex[i] = rf.lastLogIndex() + 1
+  }
+
+  go rf.heartbeatLoop(rf.currentTerm)
+}
+
+func (rf *Raft) heartbeatLoop(term int) {
+  for !rf.killed() {
+    rf.mu.Lock()
+    stillLeader := rf.role == leader && rf.currentTerm == term
+    rf.mu.Unlock()
+    if !stillLeader {
+      return
+    }
+
+    go rf.broadcastAppendEntries()
+    time.Sleep(heartbeatInterval)
+  }
+}
+
+/*
+****************************************************
+Replication
+****************************************************
+*/
+
+func (rf *Raft) broadcastAppendEntries() {
+  rf.mu.Lock()
+  if rf.role != leader {
+    rf.mu.Unlock()
+    return
+  }
+  term := rf.currentTerm
+  rf.mu.Unlock()
+
+  for i := range rf.peers {
+    if i == rf.me {
+      continue
+    }
+    go rf.replicateTo(i, term)
+  }
+}
+
+func (rf *Raft) replicateTo(peer int, term int) {
+  rf.mu.Lock()
+  if rf.role != leader || rf.currentTerm != term {
+    rf.mu.Unlock()
+    return
+  }
+
+  prevLogIndex := rf.nextIndex[peer] - 1
+  if prevLogIndex < rf.lastIncludedIndex {
+    rf.mu.Unlock()
+    return // would need a snapshot transfer; out of scope for this group size
+  }
+
+  entries := append([]logEntry{}, rf.log[rf.logPos(prevLogIndex)+1:]...)
+  args := &AppendEntriesArgs{
+    Term: term,
+    LeaderID: rf.me,
+    PrevLogIndex: prevLogIndex,
+    PrevLogTerm: rf.entryAt(prevLogIndex).Term,
+    Entries: entries,
+    LeaderCommit: rf.commitIndex,
+  }
+  rf.mu.Unlock()
+
+  reply := new(AppendEntriesReply)
+  if !rf.rpc.Call(rf.peers[peer], rf.serviceName+".AppendEntries", args, reply) {
+    return
+  }
+
+  rf.mu.Lock()
+  defer rf.mu.Unlock()
+
+  if reply.Term > rf.currentTerm {
+    rf.becomeFollowerLocked(reply.Term)
+    return
+  }
+  if rf.role != leader || rf.currentTerm != term {
+    return
+  }
+
+  if reply.Success {
+    rf.matchIndex[peer] = args.PrevLogIndex + len(args.Entries)
+    rf.nextIndex[peer] = rf.matchIndex[peer] + 1
+    rf.advanceCommitIndexLocked()
+    return
+  }
+
+  if reply.ConflictTerm == 0 {
+    rf.nextIndex[peer] = reply.ConflictIndex
+  } else {
+    idx := rf.lastLogIndex()
+    for idx > rf.lastIncludedIndex && rf.entryAt(idx).Term > reply.ConflictTerm {
+      idx--
+    }
+    if idx > rf.lastIncludedIndex && rf.entryAt(idx).Term == reply.ConflictTerm {
+      rf.nextIndex[peer] = idx + 1
+    } else {
+      rf.nextIndex[peer] = reply.ConflictIndex
+    }
+  }
+}
+
+// advanceCommitIndexLocked moves commitIndex forward to the highest
+// index replicated on a majority of peers from the current term.
+func (rf *Raft) advanceCommitIndexLocked() {
+  for n := rf.lastLogIndex(); n > rf.commitIndex; n-- {
+    if rf.entryAt(n).Term != rf.currentTerm {
+      continue
+    }
+
+    replicated := 1
+    for i := range rf.peers {
+      if i != rf.me && rf.matchIndex[i] >= n {
+        replicated++
+      }
+    }
+
+    if replicated*2 > len(rf.peers) {
+      rf.commitIndex = n
+      rf.applyCond.Broadcast()
+      return
+    }
+  }
+}
+
+/*
+****************************************************
+Apply loop
+****************************************************
+*/
+
+func (rf *Raft) applyLoop() {
+  rf.mu.Lock()
+  defer rf.mu.Unlock()
+
+  for {
+    for rf.lastApplied >= rf.commitIndex && !rf.dead {
+      rf.applyCond.Wait()
+    }
+    if rf.dead {
+      return
+    }
+
+    rf.lastApplied++
+    msg := ApplyMsg{
+      CommandValid: true,
+      Command: rf.entryAt(rf.lastApplied).Command,
+      CommandIndex: rf.lastApplied,
+    }
+
+    rf.mu.Unlock()
+    rf.applyCh <- msg
+    rf.mu.Lock()
+  }
+}
+
+func min(a, b int) int {
+  if a < b {
+    return a
+  }
+  return b
+}
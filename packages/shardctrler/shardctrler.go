@@ -0,0 +1,327 @@
+// Package shardctrler implements the small replicated configuration
+// service that assigns shards of the keyspace to replica groups. It is
+// itself just another Raft group (using packages/raft), so its own
+// config log is consistent and survives the loss of a minority of its
+// members the same way a group's message log does.
+package shardctrler
+
+import (
+  "encoding/gob"
+  "sort"
+  "sync"
+
+  "github.com/jmoldow/MylarMail/packages/raft"
+)
+
+// NShards is the number of shards the keyspace is split into. A
+// username's shard is hash(username) % NShards.
+const NShards = 10
+
+const (
+  OK = "OK"
+  ErrWrongLeader = "ErrWrongLeader"
+)
+
+// Config is one versioned assignment of shards to groups. Config.Num
+// increases by one on every Join, Leave, or Move.
+type Config struct {
+  Num int
+  Shards [NShards]int // shard -> GID, 0 means unassigned
+  Groups map[int][]string // GID -> replica addresses
+}
+
+func (c Config) clone() Config {
+  next := Config{Num: c.Num, Shards: c.Shards}
+  next.Groups = make(map[int][]string, len(c.Groups))
+  for gid, servers := range c.Groups {
+    next.Groups[gid] = append([]string{}, servers...)
+  }
+  return next
+}
+
+type JoinArgs struct {
+  GID int
+  Servers []string
+}
+
+type JoinReply struct {
+  Err string
+}
+
+type LeaveArgs struct {
+  GIDs []int
+}
+
+type LeaveReply struct {
+  Err string
+}
+
+type MoveArgs struct {
+  Shard int
+  GID int
+}
+
+type MoveReply struct {
+  Err string
+}
+
+type QueryArgs struct {
+  Num int // -1 means "the latest config"
+}
+
+type QueryReply struct {
+  Config Config
+  Err string
+}
+
+// op is the command type submitted to the controller's own Raft group.
+// ReqID is unique per submission (not per Join/Leave/Move call site) so
+// applyLoop can tell whether the command it just applied at an index is
+// actually the one a given submit call is waiting on, rather than
+// assuming any commit at that index must be it.
+type op struct {
+  Kind string // "Join", "Leave", or "Move"
+  GID int
+  Servers []string
+  GIDs []int
+  Shard int
+  ReqID int64
+}
+
+// op travels behind raft's interface-typed Command field, both in
+// AppendEntries RPCs and in the persisted log, so gob must know it.
+func init() {
+  gob.Register(op{})
+}
+
+// ShardCtrler is one member of the replicated configuration service.
+type ShardCtrler struct {
+  mu sync.Mutex
+  rf *raft.Raft
+  applyCh chan raft.ApplyMsg
+  configs []Config
+  waiters map[int]pendingOp
+  nextReqID int64
+}
+
+// pendingOp is what submit leaves behind for applyLoop to find at a log
+// index: the ReqID it's actually waiting on, and the channel to signal.
+type pendingOp struct {
+  reqID int64
+  ch chan op
+}
+
+// Make starts a ShardCtrler peer, running its own Raft group over
+// peers.
+func Make(peers []string, me int, persister raft.Persister, rpc raft.RPCClient) *ShardCtrler {
+  sc := &ShardCtrler{
+    configs: []Config{{Groups: make(map[int][]string)}},
+    waiters: make(map[int]pendingOp),
+  }
+  sc.applyCh = make(chan raft.ApplyMsg, 16)
+  sc.rf = raft.Make(peers, me, persister, rpc, sc.applyCh, "ShardCtrler")
+
+  go sc.applyLoop()
+
+  return sc
+}
+
+// submit proposes o to the controller's Raft group and waits for it to
+// be applied. It returns false if this peer isn't the group's leader,
+// or if a leadership change overwrote the log entry this call started
+// with something else before it committed.
+func (sc *ShardCtrler) submit(o op) bool {
+  // sc.mu is held across Start so applyLoop cannot apply index before
+  // its waiter is registered.
+  sc.mu.Lock()
+  sc.nextReqID++
+  o.ReqID = sc.nextReqID
+
+  index, _, isLeader := sc.rf.Start(o)
+  if !isLeader {
+    sc.mu.Unlock()
+    return false
+  }
+
+  ch := make(chan op, 1)
+  sc.waiters[index] = pendingOp{reqID: o.ReqID, ch: ch}
+  sc.mu.Unlock()
+
+  applied := <-ch
+  return applied.ReqID == o.ReqID
+}
+
+// Join adds gid as a new group owning servers, rebalancing shards
+// across every known group.
+func (sc *ShardCtrler) Join(args *JoinArgs, reply *JoinReply) error {
+  if !sc.submit(op{Kind: "Join", GID: args.GID, Servers: args.Servers}) {
+    reply.Err = ErrWrongLeader
+    return nil
+  }
+  reply.Err = OK
+  return nil
+}
+
+// Leave removes the given groups, reassigning their shards across the
+// groups that remain.
+func (sc *ShardCtrler) Leave(args *LeaveArgs, reply *LeaveReply) error {
+  if !sc.submit(op{Kind: "Leave", GIDs: args.GIDs}) {
+    reply.Err = ErrWrongLeader
+    return nil
+  }
+  reply.Err = OK
+  return nil
+}
+
+// Move assigns a single shard to gid directly, overriding the
+// automatic rebalancing Join/Leave perform.
+func (sc *ShardCtrler) Move(args *MoveArgs, reply *MoveReply) error {
+  if !sc.submit(op{Kind: "Move", Shard: args.Shard, GID: args.GID}) {
+    reply.Err = ErrWrongLeader
+    return nil
+  }
+  reply.Err = OK
+  return nil
+}
+
+// Query returns the config numbered args.Num, or the latest config if
+// args.Num is negative or beyond the log. Queries are served from this
+// peer's local config log rather than going through Raft, so they can
+// be stale on a partitioned-away follower; callers that need a
+// linearizable read should retry against the group's current leader.
+func (sc *ShardCtrler) Query(args *QueryArgs, reply *QueryReply) error {
+  sc.mu.Lock()
+  defer sc.mu.Unlock()
+
+  if args.Num < 0 || args.Num >= len(sc.configs) {
+    reply.Config = sc.configs[len(sc.configs)-1]
+  } else {
+    reply.Config = sc.configs[args.Num]
+  }
+  reply.Err = OK
+  return nil
+}
+
+func (sc *ShardCtrler) applyLoop() {
+  for msg := range sc.applyCh {
+    if !msg.CommandValid {
+      continue
+    }
+    o := msg.Command.(op)
+
+    sc.mu.Lock()
+    switch o.Kind {
+    case "Join":
+      sc.applyJoinLocked(o.GID, o.Servers)
+    case "Leave":
+      sc.applyLeaveLocked(o.GIDs)
+    case "Move":
+      sc.applyMoveLocked(o.Shard, o.GID)
+    }
+    if waiter, ok := sc.waiters[msg.CommandIndex]; ok {
+      delete(sc.waiters, msg.CommandIndex)
+      waiter.ch <- o
+    }
+    sc.mu.Unlock()
+  }
+}
+
+func (sc *ShardCtrler) latestLocked() Config {
+  return sc.configs[len(sc.configs)-1]
+}
+
+func (sc *ShardCtrler) applyJoinLocked(gid int, servers []string) {
+  next := sc.latestLocked().clone()
+  next.Num++
+  next.Groups[gid] = servers
+  rebalance(&next)
+  sc.configs = append(sc.configs, next)
+}
+
+func (sc *ShardCtrler) applyLeaveLocked(gids []int) {
+  next := sc.latestLocked().clone()
+  next.Num++
+  for _, gid := range gids {
+    delete(next.Groups, gid)
+  }
+  rebalance(&next)
+  sc.configs = append(sc.configs, next)
+}
+
+func (sc *ShardCtrler) applyMoveLocked(shard int, gid int) {
+  next := sc.latestLocked().clone()
+  next.Num++
+  next.Shards[shard] = gid
+  sc.configs = append(sc.configs, next)
+}
+
+// rebalance spreads the NShards shards as evenly as possible across
+// cfg.Groups, deterministically (by sorted GID) so every replica of
+// the controller computes the same assignment from the same op. A
+// shard keeps its current owner whenever that owner still exists and
+// isn't over its fair share, so a Join or Leave only moves the shards
+// that actually need to move instead of reshuffling the whole
+// keyspace.
+func rebalance(cfg *Config) {
+  if len(cfg.Groups) == 0 {
+    for shard := range cfg.Shards {
+      cfg.Shards[shard] = 0
+    }
+    return
+  }
+
+  gids := make([]int, 0, len(cfg.Groups))
+  for gid := range cfg.Groups {
+    gids = append(gids, gid)
+  }
+  sort.Ints(gids)
+
+  target := NShards / len(gids)
+  extra := NShards % len(gids)
+
+  owned := make(map[int][]int, len(gids)) // gid -> shards it keeps
+  pool := make([]int, 0)                  // shards needing a new owner
+  for shard, gid := range cfg.Shards {
+    if _, ok := cfg.Groups[gid]; ok {
+      owned[gid] = append(owned[gid], shard)
+    } else {
+      pool = append(pool, shard)
+    }
+  }
+
+  wantFor := func(i int) int {
+    if i < extra {
+      return target + 1
+    }
+    return target
+  }
+
+  for i, gid := range gids {
+    want := wantFor(i)
+    shards := owned[gid]
+    sort.Ints(shards)
+    for len(shards) > want {
+      pool = append(pool, shards[len(shards)-1])
+      shards = shards[:len(shards)-1]
+    }
+    owned[gid] = shards
+  }
+
+  sort.Ints(pool)
+  pos := 0
+  for i, gid := range gids {
+    want := wantFor(i)
+    shards := owned[gid]
+    for len(shards) < want && pos < len(pool) {
+      shards = append(shards, pool[pos])
+      pos++
+    }
+    owned[gid] = shards
+  }
+
+  for gid, shards := range owned {
+    for _, shard := range shards {
+      cfg.Shards[shard] = gid
+    }
+  }
+}
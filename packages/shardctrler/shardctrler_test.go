@@ -0,0 +1,95 @@
+package shardctrler
+
+import "testing"
+
+func newConfigWithGroups(gids ...int) Config {
+  cfg := Config{Groups: make(map[int][]string)}
+  for _, gid := range gids {
+    cfg.Groups[gid] = []string{}
+  }
+  rebalance(&cfg)
+  return cfg
+}
+
+func countShards(cfg Config) map[int]int {
+  counts := make(map[int]int)
+  for _, gid := range cfg.Shards {
+    counts[gid]++
+  }
+  return counts
+}
+
+func TestRebalanceEvenlySpreadsShards(t *testing.T) {
+  cfg := newConfigWithGroups(100, 101, 102)
+
+  counts := countShards(cfg)
+  if len(counts) != 3 {
+    t.Fatalf("rebalance assigned shards to %d groups, want 3", len(counts))
+  }
+  for gid, n := range counts {
+    if n < NShards/3 || n > NShards/3+1 {
+      t.Errorf("group %d owns %d shards, want %d or %d", gid, n, NShards/3, NShards/3+1)
+    }
+  }
+}
+
+func TestRebalanceNoGroupsUnassignsEverything(t *testing.T) {
+  cfg := Config{Groups: make(map[int][]string)}
+  rebalance(&cfg)
+
+  for shard, gid := range cfg.Shards {
+    if gid != 0 {
+      t.Errorf("shard %d assigned to %d, want 0 (unassigned)", shard, gid)
+    }
+  }
+}
+
+func TestRebalanceJoinMovesOnlyWhatsNecessary(t *testing.T) {
+  cfg := newConfigWithGroups(100, 101)
+  before := cfg.Shards
+
+  cfg.Groups[102] = []string{}
+  rebalance(&cfg)
+
+  moved := 0
+  for shard, gid := range cfg.Shards {
+    if gid != before[shard] {
+      moved++
+    }
+  }
+
+  // Only the new group's fair share should move; the rest of the
+  // keyspace should keep its existing owner.
+  want := NShards / 3
+  if moved > want+1 {
+    t.Errorf("Join moved %d shards, want at most %d", moved, want+1)
+  }
+}
+
+func TestRebalanceLeaveOnlyReassignsOrphanedShards(t *testing.T) {
+  cfg := newConfigWithGroups(100, 101, 102)
+  before := cfg.Shards
+
+  delete(cfg.Groups, 102)
+  rebalance(&cfg)
+
+  for shard, gid := range cfg.Shards {
+    if before[shard] != 102 && gid != before[shard] {
+      t.Errorf("shard %d owned by %d (unaffected by Leave) moved to %d", shard, before[shard], gid)
+    }
+  }
+  for _, gid := range cfg.Shards {
+    if gid == 102 {
+      t.Errorf("shard still assigned to departed group 102")
+    }
+  }
+}
+
+func TestRebalanceIsDeterministic(t *testing.T) {
+  a := newConfigWithGroups(100, 101, 102)
+  b := newConfigWithGroups(102, 100, 101)
+
+  if a.Shards != b.Shards {
+    t.Fatalf("rebalance produced different assignments for the same group set: %v vs %v", a.Shards, b.Shards)
+  }
+}